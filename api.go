@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"watchdog/process"
+)
+
+// Instance as exposed by the status API
+type instanceStatus struct {
+	ID string                      `json:"id"`
+	Name string                    `json:"name"`
+	Target string                  `json:"target"`
+	Pid int                        `json:"pid"`
+	State string                   `json:"state"`
+	// Last STATUS sent on NOTIFY_SOCKET
+	NotifyStatus string            `json:"notify_status,omitempty"`
+	Started time.Time              `json:"started"`
+	ExitStatus *process.ExitStatus `json:"exit_status,omitempty"`
+	// Last samples of the resources used, oldest first
+	Usage []process.Usage          `json:"usage,omitempty"`
+}
+
+// Serve the status API on the control address of the configuration
+func startControl() {
+	if configuration.Control == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/events", serveEvents)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/logs", serveLogs)
+	go func() {
+		err := http.ListenAndServe(configuration.Control, mux)
+		logger.Error("Status API stopped", zap.Error(err))
+	}()
+}
+
+// List every instance with its state
+func serveStatus(writer http.ResponseWriter, request *http.Request) {
+	statuses := []instanceStatus{}
+	launchedLock.Lock()
+	for _, processus := range launchedProcess {
+		statuses = append(statuses, instanceStatus{
+			ID: processus.ID,
+			Name: processus.Name,
+			Target: processus.Server.Name,
+			Pid: processus.Pid,
+			State: processus.State(),
+			NotifyStatus: processus.NotifyStatus(),
+			Started: processus.Started,
+			ExitStatus: processus.LastExit(),
+			Usage: processus.UsageHistory(),
+		})
+	}
+	launchedLock.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(statuses)
+}
+
+// List the last events, oldest first
+func serveEvents(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(recordedEvents())
+}
+
+// List the last records of output of an instance, oldest first. The instance
+// is given by the instance parameter and the number of records by tail, every
+// record kept by default.
+func serveLogs(writer http.ResponseWriter, request *http.Request) {
+	id := request.URL.Query().Get("instance")
+	tail := 0
+	if value := request.URL.Query().Get("tail"); value != "" {
+		var err error
+		if tail, err = strconv.Atoi(value); err != nil || tail < 0 {
+			http.Error(writer, "Invalid tail " + value, http.StatusBadRequest)
+			return
+		}
+	}
+	launchedLock.Lock()
+	processus, ok := launchedProcess[id]
+	launchedLock.Unlock()
+	if !ok {
+		http.Error(writer, "Unknown instance " + id, http.StatusNotFound)
+		return
+	}
+
+	lines := processus.Tail(tail)
+	if lines == nil {
+		lines = []process.OutputLine{}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(lines)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"watchdog/process"
+)
+
+// Print the last records of output of an instance from the control API of the
+// running watchdog: watchdog logs [--tail N] [--control address] <instance>
+func logsCommand(arguments []string) int {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	tail := flags.Int("tail", 100, "Records printed, 0 for every record kept")
+	control := flags.String("control", "", "Control address of the watchdog, read from config.json by default")
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: watchdog logs [--tail N] [--control address] <instance>")
+		return 2
+	}
+
+	if *control == "" {
+		var config Config
+		if content, err := ioutil.ReadFile("config.json"); err == nil {
+			json.Unmarshal(content, &config)
+		}
+		*control = config.Control
+	}
+	if *control == "" {
+		fmt.Fprintln(os.Stderr, "No control address in config.json")
+		return 1
+	}
+
+	query := url.Values{"instance": {flags.Arg(0)}, "tail": {strconv.Itoa(*tail)}}
+	response, err := http.Get("http://" + *control + "/logs?" + query.Encode())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to reach the watchdog:", err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		fmt.Fprint(os.Stderr, string(message))
+		return 1
+	}
+
+	var lines []process.OutputLine
+	if err := json.NewDecoder(response.Body).Decode(&lines); err != nil {
+		fmt.Fprintln(os.Stderr, "Unexpected answer of the watchdog:", err)
+		return 1
+	}
+	for _, line := range lines {
+		if line.Stream == "stderr" {
+			fmt.Fprintln(os.Stderr, line.Line)
+		} else {
+			fmt.Fprintln(os.Stdout, line.Line)
+		}
+	}
+	return 0
+}
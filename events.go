@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"watchdog/process"
+)
+
+// Kinds of events
+const (
+	eventRestarted = "restarted"
+	eventHung = "hung"
+	eventHealthFailed = "health-failed"
+	eventResourceExceeded = "resource-exceeded"
+	eventCrashed = "crashed"
+	eventAlert = "alert"
+	eventStarted = "started"
+	eventFatal = "fatal"
+	eventTargetDown = "target-down"
+)
+
+// Events kept in memory
+const maxEvents = 1000
+
+// Records of output attached to the failure events
+const eventOutputLines = 100
+
+// Something which happened to an instance
+type event struct {
+	Time time.Time     `json:"time"`
+	Kind string        `json:"kind"`
+	Instance string    `json:"instance"`
+	Process string     `json:"process"`
+	Target string      `json:"target"`
+	Message string     `json:"message"`
+	// Whether the event is sent to the notifiers
+	Notify bool        `json:"notify"`
+	// Last records of output of a failed instance
+	Output []process.OutputLine `json:"output,omitempty"`
+}
+
+// Last events, oldest first, guarded by eventsLock
+var events []event
+var eventsLock sync.Mutex
+
+// Record an event on an instance and write it to the watchdog log
+func recordEvent(kind string, processus process.StartedProcess, notify bool, message string) {
+	storeEvent(kind, processus, notify, message, nil)
+}
+
+// Record and notify a failure of an instance with its last records of output
+func recordFailure(kind string, processus process.StartedProcess, message string) {
+	storeEvent(kind, processus, true, message, processus.Tail(eventOutputLines))
+}
+
+// Store an event, write it to the watchdog log and send it to the notifiers
+func storeEvent(kind string, processus process.StartedProcess, notify bool, message string,
+	output []process.OutputLine) {
+	recorded := event{
+		Time: time.Now(),
+		Kind: kind,
+		Instance: processus.ID,
+		Process: processus.Name,
+		Target: processus.Server.Name,
+		Message: message,
+		Notify: notify,
+		Output: output,
+	}
+	logger.Info("Event " + kind, zap.String("instance", recorded.Instance),
+		zap.String("target", recorded.Target), zap.String("message", message))
+
+	if notify {
+		process.Notify(process.Notification{
+			Time: recorded.Time,
+			Kind: kind,
+			Instance: recorded.Instance,
+			Process: recorded.Process,
+			Target: recorded.Target,
+			Message: message,
+			Output: output,
+		})
+	}
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	events = append(events, recorded)
+	if len(events) > maxEvents {
+		events = events[len(events) - maxEvents:]
+	}
+}
+
+// Copy of the events recorded, oldest first
+func recordedEvents() []event {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	return append([]event{}, events...)
+}
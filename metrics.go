@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"watchdog/process"
+)
+
+// Counters of the watchdog itself, guarded by metricsLock
+var metricsLock sync.Mutex
+// Restarts per instance ID
+var restartCounts = make(map[string]uint64)
+// How the last instance replaced ended, per instance ID
+var replacedExits = make(map[string]*process.ExitStatus)
+// Calls to the watch callbacks and their total duration, per process and
+// callback
+var callbackCounts = make(map[[2]string]uint64)
+var callbackSeconds = make(map[[2]string]float64)
+
+// Count the restart of an instance
+func countRestart(previous process.StartedProcess) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	restartCounts[previous.ID]++
+	if status := previous.LastExit(); status != nil {
+		replacedExits[previous.ID] = status
+	}
+}
+
+// Count a call to a watch callback which started at start
+func timeCallback(processName string, callback string, start time.Time) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	key := [2]string{processName, callback}
+	callbackCounts[key]++
+	callbackSeconds[key] += time.Since(start).Seconds()
+}
+
+// A metric family in the Prometheus text format
+type metricFamily struct {
+	name string
+	help string
+	kind string
+	samples []string
+}
+
+// Escape a label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Add a sample of the family, labels are name and value pairs
+func (family *metricFamily) add(value float64, labels ...string) {
+	family.addNamed(family.name, value, labels...)
+}
+
+// Add a sample with another name than the family, such as the _sum and
+// _count of a summary
+func (family *metricFamily) addNamed(name string, value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i + 1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i] + `="` + labelEscaper.Replace(labels[i + 1]) + `"`)
+	}
+	sample := name
+	if len(pairs) > 0 {
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	family.samples = append(family.samples, sample + " " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// Write the families having samples
+func writeFamilies(writer io.Writer, families []*metricFamily) {
+	for _, family := range families {
+		if len(family.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, sample := range family.samples {
+			io.WriteString(writer, sample)
+		}
+	}
+}
+
+// Convert a boolean to a sample value
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Expose the instances and the watchdog counters in the Prometheus text format
+func serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	up := &metricFamily{name: "watchdog_instance_up", kind: "gauge",
+		help: "Whether the instance is running."}
+	state := &metricFamily{name: "watchdog_instance_state", kind: "gauge",
+		help: "State of the instance (STARTING, READY or UNHEALTHY)."}
+	restarts := &metricFamily{name: "watchdog_instance_restarts_total", kind: "counter",
+		help: "Instances replaced by the watchdog."}
+	exitCode := &metricFamily{name: "watchdog_instance_last_exit_code", kind: "gauge",
+		help: "Exit code of the instance when it last ended, -1 when killed by a signal."}
+	healthUp := &metricFamily{name: "watchdog_healthcheck_up", kind: "gauge",
+		help: "Whether the last probe of the health check passed."}
+	healthLatency := &metricFamily{name: "watchdog_healthcheck_latency_seconds", kind: "gauge",
+		help: "Duration of the last probe of the health check."}
+	healthProbes := &metricFamily{name: "watchdog_healthcheck_probes_total", kind: "counter",
+		help: "Probes of the health check."}
+	healthFailures := &metricFamily{name: "watchdog_healthcheck_failures_total", kind: "counter",
+		help: "Failed probes of the health check."}
+	dialErrors := &metricFamily{name: "watchdog_ssh_dial_errors_total", kind: "counter",
+		help: "Failed SSH connections per target."}
+	cpu := &metricFamily{name: "watchdog_instance_cpu_percent", kind: "gauge",
+		help: "Percent of one CPU used by the instance."}
+	rss := &metricFamily{name: "watchdog_instance_rss_bytes", kind: "gauge",
+		help: "Resident memory of the instance."}
+	fds := &metricFamily{name: "watchdog_instance_open_fds", kind: "gauge",
+		help: "Open file descriptors of the instance."}
+	threads := &metricFamily{name: "watchdog_instance_threads", kind: "gauge",
+		help: "Threads of the instance."}
+	readBytes := &metricFamily{name: "watchdog_instance_read_bytes_total", kind: "counter",
+		help: "Bytes read from storage by the instance."}
+	writeBytes := &metricFamily{name: "watchdog_instance_write_bytes_total", kind: "counter",
+		help: "Bytes written to storage by the instance."}
+	callbacks := &metricFamily{name: "watchdog_watch_callback_duration_seconds", kind: "summary",
+		help: "Duration of the watch callbacks."}
+
+	launchedLock.Lock()
+	var instances []process.StartedProcess
+	for _, processus := range launchedProcess {
+		instances = append(instances, processus)
+	}
+	launchedLock.Unlock()
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	metricsLock.Lock()
+	for _, processus := range instances {
+		labels := []string{"process", processus.Name, "instance", processus.ID, "target", processus.Server.Name}
+		up.add(boolValue(processus.Up()), labels...)
+		for _, value := range []string{process.StateStarting, process.StateReady, process.StateUnhealthy} {
+			state.add(boolValue(processus.State() == value), append(labels, "state", value)...)
+		}
+		restarts.add(float64(restartCounts[processus.ID]), labels...)
+		if status := processus.LastExit(); status != nil {
+			exitCode.add(float64(status.Code), labels...)
+		} else if status := replacedExits[processus.ID]; status != nil {
+			exitCode.add(float64(status.Code), labels...)
+		}
+		if health := processus.HealthStats(); health != nil {
+			healthUp.add(boolValue(health.Healthy), labels...)
+			healthLatency.add(health.Latency.Seconds(), labels...)
+			healthProbes.add(float64(health.Probes), labels...)
+			healthFailures.add(float64(health.Failures), labels...)
+		}
+		if usage := processus.Usage(); usage != nil {
+			cpu.add(usage.CPU, labels...)
+			rss.add(float64(usage.RSS), labels...)
+			fds.add(float64(usage.FDs), labels...)
+			threads.add(float64(usage.Threads), labels...)
+			readBytes.add(float64(usage.ReadBytes), labels...)
+			writeBytes.add(float64(usage.WriteBytes), labels...)
+		}
+	}
+
+	var keys [][2]string
+	for key := range callbackCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] + "\x00" + keys[i][1] < keys[j][0] + "\x00" + keys[j][1]
+	})
+	for _, key := range keys {
+		labels := []string{"process", key[0], "callback", key[1]}
+		callbacks.addNamed(callbacks.name + "_sum", callbackSeconds[key], labels...)
+		callbacks.addNamed(callbacks.name + "_count", float64(callbackCounts[key]), labels...)
+	}
+	metricsLock.Unlock()
+
+	counts := process.SSHDialErrors()
+	var targets []string
+	for target := range counts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		dialErrors.add(float64(counts[target]), "target", target)
+	}
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeFamilies(writer, []*metricFamily{up, state, restarts, exitCode, healthUp, healthLatency,
+		healthProbes, healthFailures, dialErrors, cpu, rss, fds, threads, readBytes, writeBytes, callbacks})
+}
@@ -0,0 +1,163 @@
+package process
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Run a command on the watchdog host, an action of AlertRule
+const ActionHook = "hook"
+
+// AlertRule trigger an action when the output of an instance match a pattern
+// count times within a duration, such as 5 "connection refused" in 1 minute
+type AlertRule struct {
+	// Regular expression matched against each record of output
+	Pattern string     `json:"pattern"`
+	// stdout or stderr, both by default
+	Stream string      `json:"stream"`
+	// Matches triggering the rule (1 by default) and the window they are
+	// counted in (1m by default)
+	Count int          `json:"count"`
+	Within Duration    `json:"within"`
+	// notify (default), restart or hook
+	Action string      `json:"action"`
+	// Command run by sh on the watchdog host by the hook action
+	Hook string        `json:"hook"`
+}
+
+// Alert is a rule triggered by the output of an instance
+type Alert struct {
+	Rule AlertRule
+	// Record which triggered the rule and the matches counted
+	Line string
+	Matches int
+}
+
+// Alerts waiting to be handled per instance, the next ones are dropped
+const pendingAlerts = 16
+
+// Validate return an error if the rule can not be evaluated
+func (rule AlertRule) Validate() error {
+	if _, err := regexp.Compile(rule.Pattern); err != nil || rule.Pattern == "" {
+		return errors.New("Invalid alert pattern " + rule.Pattern)
+	}
+	switch rule.Stream {
+	case "", "stdout", "stderr":
+	default:
+		return errors.New("Unknown alert stream " + rule.Stream)
+	}
+	if rule.Count < 0 || rule.Within < 0 {
+		return errors.New("Alert count and within can not be negative")
+	}
+	switch rule.Action {
+	case "", ActionNotify, ActionRestart:
+	case ActionHook:
+		if rule.Hook == "" {
+			return errors.New("Alert hook action require a hook command")
+		}
+	default:
+		return errors.New("Unknown alert action " + rule.Action)
+	}
+	return nil
+}
+
+// String describe the condition of the rule
+func (rule AlertRule) String() string {
+	count := rule.Count
+	if count <= 0 {
+		count = 1
+	}
+	return strconv.Itoa(count) + " matches of " + rule.Pattern + " within " +
+		rule.Within.or(time.Minute).String()
+}
+
+// Evaluation of a rule on the output of an instance
+type alertState struct {
+	rule AlertRule
+	pattern *regexp.Regexp
+	// Times of the matches within the window
+	matches []time.Time
+}
+
+// Compile validated rules
+func newAlertStates(rules []AlertRule) []*alertState {
+	var alerts []*alertState
+	for _, rule := range rules {
+		alerts = append(alerts, &alertState{rule: rule, pattern: regexp.MustCompile(rule.Pattern)})
+	}
+	return alerts
+}
+
+// Count a match at now and return the matches within the window and whether
+// the rule triggered, the matches are counted again from zero once it did
+func (alert *alertState) matched(now time.Time) (int, bool) {
+	window := now.Add(-alert.rule.Within.or(time.Minute))
+	kept := alert.matches[:0]
+	for _, match := range alert.matches {
+		if match.After(window) {
+			kept = append(kept, match)
+		}
+	}
+	alert.matches = append(kept, now)
+	matches := len(alert.matches)
+	if matches < alert.rule.Count {
+		return matches, false
+	}
+	alert.matches = nil
+	return matches, true
+}
+
+// Evaluate the rules on a record of output, the alerts triggered are queued
+// for WatchAlerts
+func (state *instanceState) match(stream string, line string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	for _, alert := range state.alerts {
+		if (alert.rule.Stream != "" && alert.rule.Stream != stream) || !alert.pattern.MatchString(line) {
+			continue
+		}
+		matches, triggered := alert.matched(time.Now())
+		if !triggered {
+			continue
+		}
+		select {
+		case state.alerted <- Alert{Rule: alert.rule, Line: line, Matches: matches}:
+		default:
+		}
+	}
+}
+
+// WatchAlerts call onAlert with each alert rule triggered by the output of the
+// instance until it is retired or ends
+func (process StartedProcess) WatchAlerts(onAlert func(*StartedProcess, Alert) error) error {
+	if process.state == nil || process.state.alerted == nil {
+		return errors.New("Output of " + process.ID + " is not captured")
+	}
+	var ended chan struct{}
+	if process.exit != nil {
+		ended = process.exit.done
+	}
+	go func() {
+		for {
+			select {
+			case alert := <-process.state.alerted:
+				onAlert(&process, alert)
+			case <-process.state.retired:
+				return
+			case <-ended:
+				// The last records may have triggered rules
+				for {
+					select {
+					case alert := <-process.state.alerted:
+						onAlert(&process, alert)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
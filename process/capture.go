@@ -0,0 +1,111 @@
+package process
+
+import (
+	"time"
+)
+
+// OutputLine is a record of output of an instance, a line or the lines
+// grouped by a multiline rule
+type OutputLine struct {
+	Time time.Time     `json:"time"`
+	// stdout or stderr
+	Stream string      `json:"stream"`
+	Line string        `json:"line"`
+}
+
+// Records kept per instance by default
+const defaultTailLines = 500
+
+// Ring buffer of the last records of an instance
+type outputRing struct {
+	lines []OutputLine
+	// Index of the next record written, the oldest once the ring is full
+	next int
+	full bool
+}
+
+// Create a ring keeping size records, defaultTailLines when 0
+func newOutputRing(size int) *outputRing {
+	if size <= 0 {
+		size = defaultTailLines
+	}
+	return &outputRing{lines: make([]OutputLine, size)}
+}
+
+// Add a record, replacing the oldest one once the ring is full
+func (ring *outputRing) add(line OutputLine) {
+	ring.lines[ring.next] = line
+	ring.next++
+	if ring.next == len(ring.lines) {
+		ring.next = 0
+		ring.full = true
+	}
+}
+
+// Copy of the last n records, all of them when n is 0, oldest first
+func (ring *outputRing) last(n int) []OutputLine {
+	var ordered []OutputLine
+	if ring.full {
+		ordered = append(ordered, ring.lines[ring.next:]...)
+	}
+	ordered = append(ordered, ring.lines[:ring.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered) - n:]
+	}
+	return ordered
+}
+
+// Prepare the capture of the output of an instance: the tags of the records
+// forwarded, the sinks receiving them, the ring of the last records and the
+// alert rules
+func (state *instanceState) prepareCapture(runtime Process) {
+	state.process = runtime.Name
+	state.target = runtime.Target
+	state.sinks = lookupSinks(runtime.Logs.Sinks)
+	state.tail = newOutputRing(runtime.Logs.Tail)
+	state.alerts = newAlertStates(runtime.Alerts)
+	state.alerted = make(chan Alert, pendingAlerts)
+}
+
+// SetID set the instance ID, which also tag the output forwarded to sinks
+func (process *StartedProcess) SetID(id string) {
+	process.ID = id
+	if process.state == nil {
+		return
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	process.state.instance = id
+}
+
+// Observe the records read on a stream of the instance, keep them, evaluate
+// the alert rules and forward them
+func (state *instanceState) capture(stream string) func(string) {
+	return func(line string) {
+		state.observe(line)
+		state.keep(stream, line)
+		state.match(stream, line)
+		state.forward(stream, line)
+	}
+}
+
+// Keep a record in the ring of the instance
+func (state *instanceState) keep(stream string, line string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.tail.add(OutputLine{Time: time.Now(), Stream: stream, Line: line})
+}
+
+// Tail return the last n records of output of the instance, all those kept
+// when n is 0, oldest first. It is nil when the output is not captured.
+func (process StartedProcess) Tail(n int) []OutputLine {
+	if process.state == nil {
+		return nil
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	if process.state.tail == nil {
+		return nil
+	}
+	return process.state.tail.last(n)
+}
@@ -0,0 +1,471 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// CrashReports configure the bundles collected when an instance crash
+type CrashReports struct {
+	// Directory of the bundles, crashes by default
+	Dir string             `json:"dir"`
+	// Records of output kept per stream (200 by default)
+	Lines int              `json:"lines"`
+	// Largest core file copied (1GiB by default)
+	MaxCoreSize ByteSize   `json:"max_core_size"`
+	// Regular expressions of the names of environment variables to redact in
+	// addition to the default ones (password, secret, token, key...)
+	Redact []string        `json:"redact"`
+}
+
+// CrashReport describe a crash, it is stored as report.json in the bundle with
+// the last lines of output and the core file
+type CrashReport struct {
+	ID string                  `json:"id"`
+	Instance string            `json:"instance"`
+	Process string             `json:"process"`
+	Target string              `json:"target"`
+	Pid int                    `json:"pid"`
+	Started time.Time          `json:"started"`
+	ExitStatus *ExitStatus     `json:"exit_status,omitempty"`
+	// Executable and command line of the PID
+	Executable string          `json:"executable"`
+	Command string             `json:"command"`
+	WorkingDirectory string    `json:"working_directory,omitempty"`
+	// Environment of the process when it started, secrets redacted
+	Environment []string       `json:"environment,omitempty"`
+	Usage []Usage              `json:"usage,omitempty"`
+	// Name of the core file in the bundle
+	Core string                `json:"core,omitempty"`
+	// Artifacts which could not be collected
+	Errors []string            `json:"errors,omitempty"`
+}
+
+// Defaults of CrashReports
+const defaultCrashLines = 200
+const defaultMaxCoreSize = 1 << 30
+
+// Bytes read at the end of a remote output file to find its last lines
+const remoteTailBytes = 1 << 20
+
+// Names of the environment variables redacted by default
+var secretNames = regexp.MustCompile(`(?i)(pass|secret|token|key|credential|auth|cookie|session|private)`)
+
+// Signals which make the kernel dump a core
+var coreSignals = map[string]bool{
+	"SIGQUIT": true, "SIGILL": true, "SIGTRAP": true, "SIGABRT": true, "SIGBUS": true,
+	"SIGFPE": true, "SIGSEGV": true, "SIGXCPU": true, "SIGXFSZ": true, "SIGSYS": true,
+}
+
+// Validate return an error if the bundles can not be collected
+func (reports CrashReports) Validate() error {
+	if reports.Lines < 0 {
+		return errors.New("Crash report lines can not be negative")
+	}
+	for _, pattern := range reports.Redact {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return errors.New("Invalid redact pattern " + pattern)
+		}
+	}
+	return nil
+}
+
+// RecordEnvironment read the environment and working directory of the
+// instance while it runs, they are part of its crash report
+func (process StartedProcess) RecordEnvironment() error {
+	if process.state == nil {
+		return errors.New("No state for " + process.ID)
+	}
+	directory := "/proc/" + strconv.Itoa(process.Pid)
+	var environ, cwd string
+	if process.Server.Name == "local" {
+		content, err := ioutil.ReadFile(directory + "/environ")
+		if err != nil {
+			return err
+		}
+		environ = string(content)
+		cwd, _ = os.Readlink(directory + "/cwd")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+		defer cancel()
+		// The working directory comes first, on a single line
+		output, code, err := runRemote(ctx, process, fmt.Sprintf(
+			`readlink %[1]s/cwd && cat %[1]s/environ`, directory))
+		if err != nil {
+			return err
+		}
+		lines := strings.SplitN(output, "\n", 2)
+		if code != 0 || len(lines) < 2 {
+			return errors.New("Unable to read the environment of " + process.ID)
+		}
+		cwd, environ = lines[0], lines[1]
+	}
+
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	process.state.environment = strings.FieldsFunc(environ, func(r rune) bool { return r == 0 })
+	process.state.workingDirectory = cwd
+	return nil
+}
+
+// CollectCrash store the crash report of an instance which ended in a new
+// bundle and return its ID. Remote files are fetched over SFTP, the artifacts
+// which can not be collected are listed in the report.
+func (process StartedProcess) CollectCrash(reports CrashReports) (string, error) {
+	ended := time.Now()
+	status := process.ExitStatus
+	if status == nil {
+		status = process.LastExit()
+	}
+	if status != nil && !status.Time.IsZero() {
+		ended = status.Time
+	}
+	report := CrashReport{
+		ID: process.ID + "-" + ended.UTC().Format("20060102T150405Z"),
+		Instance: process.ID,
+		Process: process.Name,
+		Target: process.Server.Name,
+		Pid: process.Pid,
+		Started: process.Started,
+		ExitStatus: status,
+		Executable: process.Exe,
+		Command: strings.TrimSpace(strings.Replace(process.Cmdline, "\x00", " ", -1)),
+		Usage: process.UsageHistory(),
+	}
+	if report.Executable == "" {
+		report.Executable = process.Executable
+	}
+
+	// The bundle may hold secrets of the process
+	if err := os.MkdirAll(reports.directory(), 0700); err != nil {
+		return "", err
+	}
+	id, err := createBundle(reports.directory(), report.ID)
+	if err != nil {
+		return "", err
+	}
+	report.ID = id
+	directory := filepath.Join(reports.directory(), id)
+
+	var environment []string
+	if process.state != nil {
+		process.state.lock.Lock()
+		environment = process.state.environment
+		report.WorkingDirectory = process.state.workingDirectory
+		process.state.lock.Unlock()
+	}
+	report.Environment = reports.redact(environment)
+
+	var client *sftp.Client
+	if process.Server.Name != "local" {
+		connection, err := dialTarget(process.Server)
+		if err == nil {
+			defer connection.Close()
+			client, err = sftp.NewClient(connection)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, "SFTP: " + err.Error())
+		} else {
+			defer client.Close()
+		}
+	}
+
+	lines := reports.Lines
+	if lines <= 0 {
+		lines = defaultCrashLines
+	}
+	for _, stream := range []string{"stdout", "stderr"} {
+		output, err := process.lastLines(client, stream, lines)
+		if err != nil {
+			report.Errors = append(report.Errors, stream + ": " + err.Error())
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(directory, stream + ".log"), []byte(output), 0600); err != nil {
+			return "", err
+		}
+	}
+
+	if status != nil && coreSignals[signalName(status.Signal)] {
+		core, err := process.fetchCore(client, report.WorkingDirectory, reports.maxCoreSize(), directory)
+		if err != nil {
+			report.Errors = append(report.Errors, "core: " + err.Error())
+		} else {
+			report.Core = core
+		}
+	}
+
+	encoded, _ := json.MarshalIndent(report, "", "  ")
+	if err := ioutil.WriteFile(filepath.Join(directory, "report.json"), encoded, 0600); err != nil {
+		return "", err
+	}
+	return report.ID, nil
+}
+
+// Directory of the bundles
+func (reports CrashReports) directory() string {
+	if reports.Dir == "" {
+		return "crashes"
+	}
+	return reports.Dir
+}
+
+// Largest core file copied
+func (reports CrashReports) maxCoreSize() int64 {
+	if reports.MaxCoreSize == 0 {
+		return defaultMaxCoreSize
+	}
+	return int64(reports.MaxCoreSize)
+}
+
+// Replace the value of the variables named like secrets
+func (reports CrashReports) redact(environment []string) []string {
+	patterns := []*regexp.Regexp{secretNames}
+	for _, pattern := range reports.Redact {
+		patterns = append(patterns, regexp.MustCompile(pattern))
+	}
+	var redacted []string
+	for _, variable := range environment {
+		name := strings.SplitN(variable, "=", 2)[0]
+		for _, pattern := range patterns {
+			if pattern.MatchString(name) {
+				variable = name + "=REDACTED"
+				break
+			}
+		}
+		redacted = append(redacted, variable)
+	}
+	return redacted
+}
+
+// Add the SIG prefix of a signal name if missing
+func signalName(signal string) string {
+	if signal == "" || strings.HasPrefix(signal, "SIG") {
+		return signal
+	}
+	return "SIG" + signal
+}
+
+// Last lines of a stream of the instance, from the output captured or from
+// the file written on the target
+func (process StartedProcess) lastLines(client *sftp.Client, stream string, count int) (string, error) {
+	if captured := process.Tail(0); captured != nil {
+		var lines []string
+		for _, line := range captured {
+			if line.Stream == stream {
+				lines = append(lines, line.Line + "\n")
+			}
+		}
+		if len(lines) > count {
+			lines = lines[len(lines) - count:]
+		}
+		return strings.Join(lines, ""), nil
+	}
+
+	file := process.Logs.Stdout
+	if stream == "stderr" {
+		file = process.Logs.Stderr
+	}
+	if client == nil {
+		return "", errors.New("Output of " + process.ID + " is not available")
+	}
+	remote, err := client.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer remote.Close()
+	info, err := remote.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > remoteTailBytes {
+		// The first line read is likely partial and dropped with the others
+		remote.Seek(info.Size() - remoteTailBytes, io.SeekStart)
+	}
+	content, err := ioutil.ReadAll(remote)
+	if err != nil {
+		return "", err
+	}
+	return lastLinesOf(content, count), nil
+}
+
+// Last count lines of a content
+func lastLinesOf(content []byte, count int) string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64 << 10), remoteTailBytes)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text() + "\n")
+		if len(lines) > count {
+			lines = lines[1:]
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Create the directory of a new bundle and return its ID, the crashes of an
+// instance within the same second are told apart by a suffix
+func createBundle(parent string, id string) (string, error) {
+	for suffix := 1; ; suffix++ {
+		name := id
+		if suffix > 1 {
+			name += "-" + strconv.Itoa(suffix)
+		}
+		err := os.Mkdir(filepath.Join(parent, name), 0700)
+		if err == nil {
+			return name, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// Copy the core file dumped by the instance into the bundle and return its
+// name
+func (process StartedProcess) fetchCore(client *sftp.Client, cwd string, maxSize int64,
+	directory string) (string, error) {
+
+	var pattern, usesPid, hostname []byte
+	var err error
+	if process.Server.Name == "local" {
+		pattern, err = ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+		usesPid, _ = ioutil.ReadFile("/proc/sys/kernel/core_uses_pid")
+		host, _ := os.Hostname()
+		hostname = []byte(host)
+	} else if client != nil {
+		pattern, err = readRemote(client, "/proc/sys/kernel/core_pattern")
+		usesPid, _ = readRemote(client, "/proc/sys/kernel/core_uses_pid")
+		hostname, _ = readRemote(client, "/proc/sys/kernel/hostname")
+	} else {
+		return "", errors.New("No SFTP connection")
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(string(pattern), "|") {
+		return "", errors.New("Core dumps are handled by " + strings.TrimSpace(string(pattern)[1:]))
+	}
+
+	executable := process.Exe
+	if executable == "" {
+		executable = process.Executable
+	}
+	glob := coreGlob(strings.TrimSpace(string(pattern)), process.Pid, path.Base(executable),
+		strings.TrimSpace(string(hostname)), strings.TrimSpace(string(usesPid)) == "1")
+	if !path.IsAbs(glob) {
+		if cwd == "" {
+			return "", errors.New("Working directory of " + process.ID + " unknown")
+		}
+		glob = path.Join(cwd, glob)
+	}
+
+	var matches []string
+	if client != nil {
+		matches, err = client.Glob(glob)
+	} else {
+		matches, err = filepath.Glob(glob)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, match := range matches {
+		var info os.FileInfo
+		if client != nil {
+			info, err = client.Stat(match)
+		} else {
+			info, err = os.Stat(match)
+		}
+		// A core dumped before the instance started belong to another process
+		if err != nil || info.ModTime().Before(process.Started.Add(-time.Second)) {
+			continue
+		}
+		if info.Size() > maxSize {
+			return "", errors.New("Core file " + match + " is larger than " + ByteSize(maxSize).String())
+		}
+		name := "core." + strconv.Itoa(process.Pid)
+		return name, copyCore(client, match, filepath.Join(directory, name))
+	}
+	return "", errors.New("No core file found for " + glob)
+}
+
+// Read a small remote file
+func readRemote(client *sftp.Client, name string) ([]byte, error) {
+	file, err := client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// Copy a local or remote core file
+func copyCore(client *sftp.Client, source string, destination string) error {
+	var reader io.ReadCloser
+	var err error
+	if client != nil {
+		reader, err = client.Open(source)
+	} else {
+		reader, err = os.Open(source)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := os.OpenFile(destination, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// Convert a core_pattern to a glob matching the core of a process. Only the
+// PID, executable name and hostname are known, the other specifiers match
+// anything.
+func coreGlob(pattern string, pid int, executable string, hostname string, usesPid bool) string {
+	var glob strings.Builder
+	hasPid := false
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i + 1 == len(pattern) {
+			glob.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'p', 'P', 'i', 'I':
+			glob.WriteString(strconv.Itoa(pid))
+			hasPid = true
+		case 'e':
+			// The name of the thread is truncated to 15 characters
+			if len(executable) > 15 {
+				executable = executable[:15]
+			}
+			glob.WriteString(executable)
+		case 'h':
+			glob.WriteString(hostname)
+		case '%':
+			glob.WriteByte('%')
+		default:
+			glob.WriteByte('*')
+		}
+	}
+	if usesPid && !hasPid {
+		glob.WriteString("." + strconv.Itoa(pid))
+	}
+	return glob.String()
+}
@@ -0,0 +1,73 @@
+package process
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Conditions a dependency must meet before a process depending on it starts
+const (
+	// Every instance of the dependency is started (default)
+	DependencyStarted = "started"
+	// Every instance of the dependency is READY
+	DependencyReady = "ready"
+)
+
+// StartOrder sort the processes so each one comes after its dependencies,
+// processes without dependencies between them keep their configuration order.
+// An error is returned for duplicate names, unknown dependencies or conditions
+// and for cycles.
+func StartOrder(processes []Process) ([]Process, error) {
+	byName := make(map[string]Process)
+	for _, process := range processes {
+		if _, ok := byName[process.Name]; ok {
+			return nil, errors.New("Duplicate process name " + process.Name)
+		}
+		byName[process.Name] = process
+	}
+	// Number of dependencies not started yet of each process
+	pending := make(map[string]int)
+	for _, process := range processes {
+		for dependency, condition := range process.DependsOn {
+			if _, ok := byName[dependency]; !ok {
+				return nil, errors.New(process.Name + " depends on unknown process " + dependency)
+			}
+			if condition != "" && condition != DependencyStarted && condition != DependencyReady {
+				return nil, errors.New("Unknown condition " + condition + " for " + process.Name +
+					" dependency on " + dependency)
+			}
+			pending[process.Name]++
+		}
+	}
+
+	var order []Process
+	started := make(map[string]bool)
+	for len(order) < len(processes) {
+		progress := false
+		for _, process := range processes {
+			if started[process.Name] || pending[process.Name] > 0 {
+				continue
+			}
+			order = append(order, process)
+			started[process.Name] = true
+			progress = true
+			for _, other := range processes {
+				if _, ok := other.DependsOn[process.Name]; ok {
+					pending[other.Name]--
+				}
+			}
+		}
+		if !progress {
+			var cycle []string
+			for _, process := range processes {
+				if !started[process.Name] {
+					cycle = append(cycle, process.Name)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, errors.New("Dependency cycle between " + strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,45 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Duration is a time.Duration read from the configuration either as a string
+// ("1m30s", "500ms") or as a number of milliseconds like Watch frequencies
+type Duration time.Duration
+
+// UnmarshalJSON accept both notations of a Duration
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*duration = Duration(time.Duration(value) * time.Millisecond)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*duration = Duration(parsed)
+	default:
+		return errors.New("Invalid duration " + string(data))
+	}
+	return nil
+}
+
+// MarshalJSON write a Duration as a string
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// Return the duration, or fallback when it is not set
+func (duration Duration) or(fallback time.Duration) time.Duration {
+	if duration <= 0 {
+		return fallback
+	}
+	return time.Duration(duration)
+}
@@ -0,0 +1,268 @@
+package process
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Email send the notifications by SMTP. Those arriving within the digest
+// window of the first one are sent together in one email.
+type Email struct {
+	// host:port of the SMTP server
+	Server string             `json:"server"`
+	// PLAIN authentication, only over TLS unless the server is local
+	Username string           `json:"username"`
+	Password string           `json:"password"`
+	// STARTTLS is used when the server offer it, fail rather than send in
+	// clear when it does not
+	RequireTLS bool           `json:"require_tls"`
+	// Accept any certificate, such as a self-signed one
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	From string               `json:"from"`
+	To []string               `json:"to"`
+	// text/template of the subject and the body executed on the Digest
+	Subject string            `json:"subject"`
+	Body string               `json:"body"`
+	// Window of the digests (1m by default, none when negative)
+	Digest Duration           `json:"digest"`
+	// Time given to each email, 30s by default
+	Timeout Duration          `json:"timeout"`
+	NotifyFilter
+}
+
+// Digest is what the templates of an email are executed on
+type Digest struct {
+	// Notifications of the email, oldest first
+	Notifications []Notification
+}
+
+// Templates of the emails by default
+const (
+	defaultEmailSubject = `[watchdog] {{if eq (len .Notifications) 1}}{{with index .Notifications 0}}` +
+		`{{.Kind}} {{or .Instance .Target}}{{end}}{{else}}{{len .Notifications}} events{{end}}`
+	defaultEmailBody = `{{range .Notifications}}{{.Time.Format "2006-01-02 15:04:05 MST"}} {{.Kind}} ` +
+		`{{or .Instance .Target}}: {{.Message}}
+{{if .Suppressed}}  {{.Suppressed}} notifications suppressed before this one
+{{end}}{{range .Output}}  {{.Stream}} | {{.Line}}
+{{end}}
+{{end}}`
+)
+
+// Notifications kept by a digest which could not be sent, the oldest are
+// dropped beyond
+const maxDigest = 100
+
+// Time before sending again a digest which could not be sent
+var emailRetryInterval = time.Minute
+
+// Validate return an error if the emails can not be sent
+func (email Email) Validate() error {
+	if _, _, err := net.SplitHostPort(email.Server); err != nil {
+		return errors.New("Email server must be host:port")
+	}
+	if email.From == "" || len(email.To) == 0 {
+		return errors.New("Email require from and to addresses")
+	}
+	if email.Timeout < 0 {
+		return errors.New("Email timeout can not be negative")
+	}
+	if _, _, err := email.templates(); err != nil {
+		return err
+	}
+	return email.NotifyFilter.Validate()
+}
+
+// Parse the templates of the subject and the body
+func (email Email) templates() (*template.Template, *template.Template, error) {
+	subject, body := email.Subject, email.Body
+	if subject == "" {
+		subject = defaultEmailSubject
+	}
+	if body == "" {
+		body = defaultEmailBody
+	}
+	parsedSubject, err := template.New("subject").Funcs(notifyFuncs).Parse(subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsedBody, err := template.New("body").Funcs(notifyFuncs).Parse(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parsedSubject, parsedBody, nil
+}
+
+// Open email notifier with its queue
+type emailNotifier struct {
+	Email
+	*notifierQueue
+	subject *template.Template
+	body *template.Template
+}
+
+// Check the configuration of an email notifier and create its queue
+func openEmail(email Email, logger *zap.Logger) (*emailNotifier, error) {
+	if err := email.Validate(); err != nil {
+		return nil, err
+	}
+	subject, body, _ := email.templates()
+	return &emailNotifier{
+		Email: email,
+		notifierQueue: newNotifierQueue(email.NotifyFilter, logger),
+		subject: subject,
+		body: body,
+	}, nil
+}
+
+// Collect the notifications queued into digests and send them until the
+// notifier is closed
+func (email *emailNotifier) run() {
+	defer close(email.stopped)
+	window := email.Digest.or(time.Minute)
+	if email.Digest < 0 {
+		window = 0
+	}
+	var pending []Notification
+	var flush <-chan time.Time
+	for {
+		select {
+		case notification := <-email.notifications:
+			pending = append(pending, notification)
+			if flush == nil {
+				flush = time.After(window)
+			}
+		case <-flush:
+			flush = nil
+			if pending = email.flush(pending); len(pending) > 0 {
+				flush = time.After(emailRetryInterval)
+			}
+		case <-email.closing:
+			for {
+				select {
+				case notification := <-email.notifications:
+					pending = append(pending, notification)
+				default:
+					if left := email.flush(pending); len(left) > 0 {
+						email.logger.Error("Notifications discarded at close of the email notifier",
+							zap.String("server", email.Server), zap.Int("discarded", len(left)))
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Send a digest, return the notifications kept to be sent again when it
+// failed
+func (email *emailNotifier) flush(pending []Notification) []Notification {
+	if len(pending) == 0 {
+		return nil
+	}
+	err := email.send(Digest{Notifications: pending})
+	if err == nil {
+		return nil
+	}
+	email.logger.Error("Unable to send the notifications by email", zap.String("server", email.Server),
+		zap.Int("notifications", len(pending)), zap.Error(err))
+	if len(pending) > maxDigest {
+		email.logger.Warn("Oldest notifications of the email digest discarded",
+			zap.String("server", email.Server), zap.Int("discarded", len(pending) - maxDigest))
+		pending = pending[len(pending) - maxDigest:]
+	}
+	return pending
+}
+
+// Render a digest and deliver it to the server
+func (email *emailNotifier) send(digest Digest) error {
+	var subject, body bytes.Buffer
+	if err := email.subject.Execute(&subject, digest); err != nil {
+		return err
+	}
+	if err := email.body.Execute(&body, digest); err != nil {
+		return err
+	}
+
+	timeout := email.Timeout.or(30 * time.Second)
+	connection, err := net.DialTimeout("tcp", email.Server, timeout)
+	if err != nil {
+		return err
+	}
+	connection.SetDeadline(time.Now().Add(timeout))
+	host, _, _ := net.SplitHostPort(email.Server)
+	client, err := smtp.NewClient(connection, host)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	defer client.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if err := client.Hello(hostname); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		config := &tls.Config{ServerName: host, InsecureSkipVerify: email.InsecureSkipVerify}
+		if err := client.StartTLS(config); err != nil {
+			return err
+		}
+	} else if email.RequireTLS {
+		return errors.New("SMTP server " + email.Server + " does not offer STARTTLS")
+	}
+	if email.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", email.Username, email.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(email.From); err != nil {
+		return err
+	}
+	for _, to := range email.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(email.message(subject.String(), body.String())); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Headers and quoted-printable body of an email
+func (email *emailNotifier) message(subject string, body string) []byte {
+	var message bytes.Buffer
+	message.WriteString("From: " + email.From + "\r\n")
+	message.WriteString("To: " + strings.Join(email.To, ", ") + "\r\n")
+	// A header holds a single line
+	subject = strings.Join(strings.Fields(subject), " ")
+	message.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	encoder := quotedprintable.NewWriter(&message)
+	encoder.Write([]byte(body))
+	encoder.Close()
+	return message.Bytes()
+}
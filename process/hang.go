@@ -0,0 +1,191 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// HangCheck define when an instance still running is considered hung
+type HangCheck struct {
+	// Longest time stdout and stderr may stay silent
+	Silence Duration          `json:"silence"`
+	// File the process touch regularly, which must have been modified less
+	// than heartbeat_max_age ago
+	Heartbeat string          `json:"heartbeat"`
+	HeartbeatMaxAge Duration  `json:"heartbeat_max_age"`
+	// Signal sent to a hung process before it is restarted so it can dump its
+	// state (SIGQUIT for a Go or Java stack dump), and the time left to it (5s)
+	DiagnosticSignal string   `json:"diagnostic_signal"`
+	DiagnosticDelay Duration  `json:"diagnostic_delay"`
+	// Time between two checks (10s)
+	Interval Duration         `json:"interval"`
+}
+
+// Validate return an error if the check can not be run
+func (check HangCheck) Validate() error {
+	if check.Silence <= 0 && check.Heartbeat == "" {
+		return errors.New("Hang check require a silence or a heartbeat")
+	}
+	if check.Heartbeat != "" && check.HeartbeatMaxAge <= 0 {
+		return errors.New("Hang check heartbeat require a heartbeat_max_age")
+	}
+	if check.DiagnosticSignal != "" && check.signal() == 0 {
+		return errors.New("Unknown diagnostic signal " + check.DiagnosticSignal)
+	}
+	return nil
+}
+
+// WatchHang check the instance at the interval of the check. Once hung the
+// instance is UNHEALTHY, receives the diagnostic signal and onHang is called
+// with the reason, then the watch stops. It also stops once a process the
+// watchdog is attached to ended or the instance is retired.
+func (process StartedProcess) WatchHang(check HangCheck, onHang func(*StartedProcess, error) error) error {
+	if err := check.Validate(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(check.Interval.or(10 * time.Second))
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if process.unwatched() {
+				return
+			}
+			reason := check.detect(process)
+			if reason == nil {
+				continue
+			}
+			if process.state != nil {
+				process.state.set(StateUnhealthy)
+			}
+			if check.DiagnosticSignal != "" && process.Signal(check.signal()) == nil {
+				time.Sleep(time.Duration(check.DiagnosticDelay.or(5 * time.Second)))
+			}
+			onHang(&process, reason)
+			return
+		}
+	}()
+	return nil
+}
+
+// Return why the instance is hung, nil if it is not or could not be checked
+func (check HangCheck) detect(process StartedProcess) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	if check.Silence > 0 {
+		silence, err := process.outputAge(ctx)
+		if err == nil && silence > time.Duration(check.Silence) {
+			return fmt.Errorf("No output for %s", silence.Round(time.Second))
+		}
+	}
+	if check.Heartbeat != "" {
+		age, err := process.fileAge(ctx, check.Heartbeat)
+		if err == nil && age > time.Duration(check.HeartbeatMaxAge) {
+			return fmt.Errorf("Heartbeat %s not touched for %s", check.Heartbeat, age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// Signal number of the diagnostic signal, 0 if unknown
+func (check HangCheck) signal() unix.Signal {
+	name := strings.ToUpper(check.DiagnosticSignal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	return unix.SignalNum(name)
+}
+
+// Time since the process last wrote to stdout or stderr. The output is seen
+// by the watchdog when captured, otherwise the log files of remote processes
+// are looked at.
+func (process StartedProcess) outputAge(ctx context.Context) (time.Duration, error) {
+	if process.state != nil && process.state.capturing {
+		process.state.lock.Lock()
+		last := process.state.lastOutput
+		process.state.lock.Unlock()
+		return process.since(last), nil
+	}
+	if process.Server.Name == "local" || process.Server.Name == "" {
+		return 0, errors.New("Output of " + process.ID + " is not captured")
+	}
+
+	command := "date +%s; stat -c %Y " + shellQuote(process.Logs.Stdout) + " " +
+		shellQuote(process.Logs.Stderr) + " 2> /dev/null"
+	output, _, err := runRemote(ctx, process, command)
+	if err != nil {
+		return 0, err
+	}
+	times, err := parseTimes(output)
+	if err != nil {
+		return 0, err
+	}
+	last := process.Started
+	for _, modified := range times[1:] {
+		if modified.After(last) {
+			last = modified
+		}
+	}
+	return process.since(last) - time.Since(times[0]), nil
+}
+
+// Time since a file was last modified on the host of the process. A file
+// missing is as old as the process.
+func (process StartedProcess) fileAge(ctx context.Context, path string) (time.Duration, error) {
+	if process.Server.Name == "local" || process.Server.Name == "" {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return process.since(time.Time{}), nil
+		} else if err != nil {
+			return 0, err
+		}
+		return process.since(info.ModTime()), nil
+	}
+
+	output, _, err := runRemote(ctx, process, "date +%s; stat -c %Y " + shellQuote(path) + " 2> /dev/null")
+	if err != nil {
+		return 0, err
+	}
+	times, err := parseTimes(output)
+	if err != nil {
+		return 0, err
+	}
+	last := time.Time{}
+	if len(times) > 1 {
+		last = times[1]
+	}
+	return process.since(last) - time.Since(times[0]), nil
+}
+
+// Time elapsed since t, never more than the time since the process started
+// so it gets the whole delay after a start before being considered hung
+func (process StartedProcess) since(t time.Time) time.Duration {
+	if t.Before(process.Started) {
+		t = process.Started
+	}
+	return time.Since(t)
+}
+
+// Parse the Unix timestamps printed on the target, the first one is its
+// current time
+func parseTimes(output string) ([]time.Time, error) {
+	var times []time.Time
+	for _, field := range strings.Fields(output) {
+		seconds, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, errors.New("Unexpected output " + output)
+		}
+		times = append(times, time.Unix(seconds, 0))
+	}
+	if len(times) == 0 {
+		return nil, errors.New("Unexpected output " + output)
+	}
+	return times, nil
+}
@@ -0,0 +1,268 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// HealthCheck define a check probing a started process at its own interval
+type HealthCheck struct {
+	// http, tcp, exec or file
+	Type string         `json:"type"`
+	// http: URL to GET, expected status (200 by default) and body regex
+	URL string          `json:"url"`
+	Status int          `json:"status"`
+	BodyRegex string    `json:"body_regex"`
+	// tcp: address to connect to, the host default to the target hostname
+	Host string         `json:"host"`
+	Port int            `json:"port"`
+	// exec: command run on the watchdog host and expected exit code
+	Command []string    `json:"command"`
+	ExitCode int        `json:"exit_code"`
+	// file: path which must have been modified less than max_age ago
+	Path string         `json:"path"`
+	MaxAge Duration     `json:"max_age"`
+	// Where the check runs for remote processes: watchdog (default), target
+	// or tunnel (http and tcp only)
+	From string         `json:"from"`
+
+	// Time between two probes (10s), time allowed to each attempt (5s),
+	// attempts repeated within a probe before it fails (0) and failed probes
+	// in a row before the process is reported crashed (3)
+	Interval Duration   `json:"interval"`
+	Timeout Duration    `json:"timeout"`
+	Retries int         `json:"retries"`
+	Threshold int       `json:"failure_threshold"`
+}
+
+// Validate return an error if the check can not be run
+func (check HealthCheck) Validate() error {
+	switch check.Type {
+	case "http":
+		if check.URL == "" {
+			return errors.New("http health check require an url")
+		}
+		if _, err := regexp.Compile(check.BodyRegex); err != nil {
+			return errors.New("Invalid body_regex: " + err.Error())
+		}
+	case "tcp":
+		if check.Port <= 0 {
+			return errors.New("tcp health check require a port")
+		}
+	case "exec":
+		if len(check.Command) == 0 {
+			return errors.New("exec health check require a command")
+		}
+	case "file":
+		if check.Path == "" || check.MaxAge <= 0 {
+			return errors.New("file health check require a path and a max_age")
+		}
+	default:
+		return errors.New("Unknown health check type " + check.Type)
+	}
+	switch check.From {
+	case "", FromWatchdog, FromTarget:
+	case FromTunnel:
+		if check.Type != "http" && check.Type != "tcp" {
+			return errors.New(check.Type + " health check can not run through a tunnel")
+		}
+	default:
+		return errors.New("Unknown health check origin " + check.From)
+	}
+	return nil
+}
+
+// Probe run the check once against the process, retrying failed attempts
+func (check HealthCheck) Probe(process StartedProcess) error {
+	var err error
+	for attempt := 0; attempt <= check.Retries; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), check.Timeout.or(5 * time.Second))
+		err = check.attempt(ctx, process)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// WatchHealth probe the process at the interval of the check, onCrash is
+// called when the check fails failure_threshold times in a row and the
+// instance is UNHEALTHY until the check pass again. The watch stops once a
+// process the watchdog is attached to ended or the instance is retired.
+func (process StartedProcess) WatchHealth(check HealthCheck, onCrash func(*StartedProcess) error) error {
+	if err := check.Validate(); err != nil {
+		return err
+	}
+	threshold := check.Threshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+
+	ticker := time.NewTicker(check.Interval.or(10 * time.Second))
+	go func() {
+		failures := 0
+		for range ticker.C {
+			if process.unwatched() {
+				ticker.Stop()
+				return
+			}
+			start := time.Now()
+			err := check.Probe(process)
+			if process.state != nil {
+				process.state.recordProbe(time.Since(start), err == nil)
+			}
+			if err != nil {
+				failures++
+			} else {
+				if failures >= threshold && process.state != nil {
+					process.state.set(StateReady)
+				}
+				failures = 0
+			}
+			if failures == threshold {
+				if process.state != nil {
+					process.state.set(StateUnhealthy)
+				}
+				onCrash(&process)
+			}
+		}
+	}()
+	return nil
+}
+
+// HealthStats summarize the probes of the health check of an instance
+type HealthStats struct {
+	Probes uint64
+	Failures uint64
+	// Duration and result of the last probe
+	Latency time.Duration
+	Healthy bool
+}
+
+// HealthStats return the statistics of the health check of the instance, nil
+// when it was never probed
+func (process StartedProcess) HealthStats() *HealthStats {
+	if process.state == nil {
+		return nil
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	if process.state.health.Probes == 0 {
+		return nil
+	}
+	stats := process.state.health
+	return &stats
+}
+
+// Count a probe of the health check
+func (state *instanceState) recordProbe(latency time.Duration, healthy bool) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.health.Probes++
+	if !healthy {
+		state.health.Failures++
+	}
+	state.health.Latency = latency
+	state.health.Healthy = healthy
+}
+
+// Run a single attempt of the check
+func (check HealthCheck) attempt(ctx context.Context, process StartedProcess) error {
+	if process.Server.Name != "local" && process.Server.Name != "" {
+		switch check.From {
+		case FromTarget:
+			return check.attemptOnTarget(ctx, process)
+		case FromTunnel:
+			return check.attemptThroughTunnel(ctx, process)
+		}
+	}
+
+	switch check.Type {
+	case "http":
+		request, err := http.NewRequest("GET", check.URL, nil)
+		if err != nil {
+			return err
+		}
+		response, err := http.DefaultClient.Do(request.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1 << 20))
+		if err != nil {
+			return err
+		}
+		return check.verifyHTTP(response.StatusCode, body)
+	case "tcp":
+		host := check.Host
+		if host == "" && process.Server.Name == "local" {
+			host = "127.0.0.1"
+		} else if host == "" {
+			host = process.Server.Hostname
+		}
+		var dialer net.Dialer
+		connection, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(check.Port)))
+		if err != nil {
+			return err
+		}
+		return connection.Close()
+	case "exec":
+		command := exec.CommandContext(ctx, check.Command[0], check.Command[1:]...)
+		err := command.Run()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return err
+		}
+		return check.verifyExitCode(command.ProcessState.ExitCode())
+	case "file":
+		info, err := os.Stat(check.Path)
+		if err != nil {
+			return err
+		}
+		return check.verifyAge(time.Since(info.ModTime()))
+	}
+	return errors.New("Unknown health check type " + check.Type)
+}
+
+// Compare an HTTP response to the expected status and body
+func (check HealthCheck) verifyHTTP(status int, body []byte) error {
+	expected := check.Status
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if status != expected {
+		return fmt.Errorf("Expected status %d got %d", expected, status)
+	}
+	if check.BodyRegex != "" && !regexp.MustCompile(check.BodyRegex).Match(body) {
+		return errors.New("Body does not match " + check.BodyRegex)
+	}
+	return nil
+}
+
+// Compare the exit code of a command to the expected one
+func (check HealthCheck) verifyExitCode(code int) error {
+	if code != check.ExitCode {
+		return fmt.Errorf("Expected exit code %d got %d", check.ExitCode, code)
+	}
+	return nil
+}
+
+// Compare the age of a file to the allowed one
+func (check HealthCheck) verifyAge(age time.Duration) error {
+	if age > time.Duration(check.MaxAge) {
+		return fmt.Errorf("%s not modified for %s", check.Path, age)
+	}
+	return nil
+}
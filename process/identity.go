@@ -0,0 +1,175 @@
+package process
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// What tells a process apart from another one which reused its PID
+type identity struct {
+	startTime uint64
+	cmdline string
+	exe string
+}
+
+// ErrPIDReused is returned when the PID of a process belongs to another one
+var ErrPIDReused = errors.New("PID no longer belongs to the process")
+
+// ErrProcessEnded is returned when signaling a process known to have ended
+var ErrProcessEnded = errors.New("Process already ended")
+
+// Record the identity of the process. A process which already ended keeps an
+// empty identity.
+func (process *StartedProcess) identify() {
+	for attempt := 0; attempt < 20; attempt++ {
+		found, err := readIdentity(*process)
+		if err != nil {
+			return
+		}
+		process.StartTime = found.startTime
+		process.Cmdline = found.cmdline
+		process.Exe = found.exe
+		// Remote processes are forked by a shell before they exec
+		if !strings.Contains(found.cmdline, "child=$!") && !strings.Contains(found.cmdline, "$$; exec ") {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// IsSameProcess tell if the PID of the process still belong to it. The PID and
+// its start time identify a process, the command line and the executable may
+// change while it runs (exec, argv rewritten, binary replaced). The executable
+// is only compared when no start time was recorded.
+func (process StartedProcess) IsSameProcess() (bool, error) {
+	if process.StartTime == 0 && process.Exe == "" {
+		return false, errors.New("No identity recorded for " + process.ID)
+	}
+	found, err := readIdentity(process)
+	if err == errNoProcess {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if process.StartTime != 0 {
+		return found.startTime == process.StartTime, nil
+	}
+	return found.exe == process.Exe, nil
+}
+
+// Make a remote command run only if the PID still belong to the process, the
+// command exit with pidReusedCode otherwise. The check happens on the target
+// right before the command to leave no room for the PID to be reused.
+func guardCommand(process StartedProcess, command string) string {
+	if process.StartTime == 0 {
+		return command
+	}
+	directory := "/proc/" + strconv.Itoa(process.Pid)
+	check := fmt.Sprintf(`[ "$(sed 's/.*) //' %s/stat 2> /dev/null | cut -d' ' -f20)" = %d ]`,
+		directory, process.StartTime)
+	return fmt.Sprintf("if %s; then %s; else exit %d; fi", check, command, pidReusedCode)
+}
+
+// Exit code of a guarded command when the PID was reused
+const pidReusedCode = 125
+
+var errNoProcess = errors.New("No such process")
+
+// Read the identity of the PID of process from /proc, locally or over SSH
+func readIdentity(process StartedProcess) (identity, error) {
+	directory := "/proc/" + strconv.Itoa(process.Pid)
+	if process.Server.Name == "local" {
+		stat, err := ioutil.ReadFile(directory + "/stat")
+		if err != nil {
+			return identity{}, errNoProcess
+		}
+		cmdline, err := ioutil.ReadFile(directory + "/cmdline")
+		if err != nil {
+			return identity{}, errNoProcess
+		}
+		exe, _ := os.Readlink(directory + "/exe")
+		return parseIdentity(string(stat), string(cmdline), exe)
+	}
+
+	session, err := createSSHSession(process.Server)
+	if err != nil {
+		return identity{}, errors.New("Failed to create SSH Session (identity)")
+	}
+	defer session.Close()
+	var buffer bytes.Buffer
+	session.Stdout = &buffer
+	// Reading exe require to be the owner of the process
+	command := wrapPrivilege(fmt.Sprintf("cat %[1]s/stat 2> /dev/null && " +
+		`echo "$(readlink %[1]s/exe 2> /dev/null)" && cat %[1]s/cmdline 2> /dev/null; true`,
+		directory), process.RunAs, process.Sudo)
+	if err := session.Run(command); err != nil {
+		return identity{}, err
+	}
+	// stat and exe are single lines, cmdline follows them
+	lines := strings.SplitN(buffer.String(), "\n", 3)
+	if len(lines) < 3 {
+		return identity{}, errNoProcess
+	}
+	return parseIdentity(lines[0], lines[2], lines[1])
+}
+
+// Parse the content of /proc/<pid>/stat, /proc/<pid>/cmdline and the target of
+// /proc/<pid>/exe
+func parseIdentity(stat string, cmdline string, exe string) (identity, error) {
+	// The command name may contain spaces and parenthesis, fields start after
+	// the last parenthesis with the state which is the 3rd field
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return identity{}, errors.New("Malformed stat " + stat)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return identity{}, errors.New("Malformed stat " + stat)
+	}
+	// starttime is the 22nd field
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return identity{}, errors.New("Malformed stat " + stat)
+	}
+	arguments := strings.Split(strings.TrimRight(cmdline, "\x00"), "\x00")
+	return identity{
+		startTime: startTime,
+		cmdline: strings.Join(arguments, " "),
+		// The binary of a running process may be replaced on disk
+		exe: strings.TrimSuffix(exe, " (deleted)"),
+	}, nil
+}
+
+// Return ErrPIDReused if the PID of the process belong to another process.
+// Processes without a recorded identity can not be checked.
+func checkIdentity(process StartedProcess) error {
+	if process.StartTime == 0 {
+		return nil
+	}
+	same, err := process.IsSameProcess()
+	if err != nil {
+		return err
+	} else if !same {
+		return ErrPIDReused
+	}
+	return nil
+}
+
+// Signal a local process with kill(2) after checking its identity
+func killLocal(process StartedProcess, signal syscall.Signal) error {
+	if err := checkIdentity(process); err != nil {
+		return err
+	}
+	err := syscall.Kill(process.Pid, signal)
+	if err == syscall.ESRCH {
+		return ErrProcessEnded
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package process
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Longest line written by default, the rest of longer lines is dropped
+const defaultMaxLineLength = 64 << 10
+
+// lineReader split the output of a process in lines of at most limit bytes,
+// the end of longer lines is dropped and replaced by a marker. The output is
+// always consumed, even binary output without line feed, so the process never
+// blocks on a full pipe.
+type lineReader struct {
+	reader *bufio.Reader
+	limit int
+}
+
+// Create a lineReader, a limit of 0 use defaultMaxLineLength
+func newLineReader(reader io.Reader, limit int) *lineReader {
+	if limit <= 0 {
+		limit = defaultMaxLineLength
+	}
+	size := limit
+	if size > defaultMaxLineLength {
+		size = defaultMaxLineLength
+	}
+	return &lineReader{reader: bufio.NewReaderSize(reader, size), limit: limit}
+}
+
+// Read the next line with its line feed, the error is set once the reader is
+// consumed and the line may then be the last one, without line feed
+func (lines *lineReader) next() (string, error) {
+	var line []byte
+	dropped := 0
+	for {
+		chunk, err := lines.reader.ReadSlice('\n')
+		ended := err == nil
+		if ended {
+			chunk = chunk[:len(chunk) - 1]
+		}
+		room := lines.limit - len(line)
+		if len(chunk) > room {
+			dropped += len(chunk) - room
+			chunk = chunk[:room]
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if dropped > 0 {
+			kept := cutRune(line)
+			dropped += len(line) - len(kept)
+			line = append(kept, truncatedMarker(dropped)...)
+		}
+		if ended {
+			line = append(line, '\n')
+		}
+		return string(line), err
+	}
+}
+
+// Marker replacing the end of a truncated line
+func truncatedMarker(dropped int) string {
+	return "... [truncated " + strconv.Itoa(dropped) + " bytes]"
+}
+
+// Remove the incomplete UTF-8 sequence left at the end of a truncated line
+func cutRune(line []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(line); i++ {
+		start := len(line) - i
+		if utf8.RuneStart(line[start]) {
+			if !utf8.FullRune(line[start:]) {
+				return line[:start]
+			}
+			return line
+		}
+	}
+	return line
+}
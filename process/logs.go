@@ -0,0 +1,313 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Rotation define when the output files of a process are rotated and how
+// long the rotated files are kept
+type Rotation struct {
+	// Rotate once the file reach this size (100MiB by default), rounded up to
+	// megabytes for local files
+	MaxSize ByteSize   `json:"max_size"`
+	// Rotate at this interval whatever the size
+	Every Duration     `json:"every"`
+	// Rotated files kept (all by default) and their longest age, rounded up
+	// to days for local files
+	MaxBackups int      `json:"max_backups"`
+	MaxAge Duration     `json:"max_age"`
+	// gzip the rotated files
+	Compress bool       `json:"compress"`
+}
+
+// Validate return an error if the logs can not be written
+func (logs Logs) Validate() error {
+	switch logs.Format {
+	case "", FormatJSON, FormatRaw, FormatJSONMerge:
+	default:
+		return errors.New("Unknown logs format " + logs.Format)
+	}
+	if logs.Timestamp && logs.Format != FormatRaw {
+		return errors.New("Timestamp is only available to the raw format")
+	}
+	if logs.Tail < 0 {
+		return errors.New("Tail can not be negative")
+	}
+	if logs.Multiline != nil {
+		if err := logs.Multiline.Validate(); err != nil {
+			return err
+		}
+	}
+	if logs.Rotation != nil {
+		return logs.Rotation.Validate()
+	}
+	return nil
+}
+
+// Validate return an error if the rotation can not be applied
+func (rotation Rotation) Validate() error {
+	if rotation.MaxBackups < 0 {
+		return errors.New("max_backups can not be negative")
+	}
+	if rotation.Every < 0 || rotation.MaxAge < 0 {
+		return errors.New("Rotation durations can not be negative")
+	}
+	return nil
+}
+
+// Default size of the files rotated
+const defaultRotationSize = 100 << 20
+
+// Formats of the output written to local files
+const (
+	// Every line is the message of a zap JSON record (default)
+	FormatJSON = "json"
+	// Lines are written as received, optionally prefixed by a timestamp
+	FormatRaw = "raw"
+	// JSON objects printed by the process are merged into the zap record,
+	// other lines are written as with json
+	FormatJSONMerge = "json-merge"
+)
+
+// Local file receiving the output of processes. Instances of a process share
+// the outputLog of each of their files.
+type outputLog struct {
+	path string
+	format string
+	timestamp bool
+	maxLineLength int
+	multiline *Multiline
+	// Logger of the json formats
+	logger *zap.Logger
+	// File of the raw format, written under lock
+	sink zapcore.WriteSyncer
+	lock sync.Mutex
+	closeSink func()
+	// Rotating file, nil without rotation
+	rotating *lumberjack.Logger
+	// Closed to stop the time based rotation
+	done chan struct{}
+	// Instances writing to the file, guarded by outputLogsLock
+	users int
+}
+
+// Open outputLog by path, guarded by outputLogsLock
+var outputLogs = make(map[string]*outputLog)
+var outputLogsLock sync.Mutex
+
+// Open the log of a file, or share the one already open
+func openOutputLog(path string, logs Logs) (*outputLog, error) {
+	outputLogsLock.Lock()
+	defer outputLogsLock.Unlock()
+	if output, ok := outputLogs[path]; ok {
+		output.users++
+		return output, nil
+	}
+
+	output := &outputLog{path: path, format: logs.Format, timestamp: logs.Timestamp,
+		maxLineLength: int(logs.MaxLineLength), multiline: logs.Multiline, users: 1}
+	var sink zapcore.WriteSyncer
+	if logs.Rotation != nil {
+		output.rotating = rotatingFile(path, *logs.Rotation)
+		sink = zapcore.AddSync(output.rotating)
+		output.done = make(chan struct{})
+		if logs.Rotation.Every > 0 {
+			go rotateEvery(output.rotating, time.Duration(logs.Rotation.Every), output.done)
+		}
+	} else if logs.Format == FormatRaw || logs.Format == FormatJSONMerge {
+		opened, closeSink, err := zap.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		sink = opened
+		output.closeSink = closeSink
+	} else {
+		logger, err := createLogger(path)
+		if err != nil {
+			return nil, err
+		}
+		output.logger = logger
+	}
+
+	encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	switch {
+	case output.logger != nil:
+	case logs.Format == FormatRaw:
+		output.sink = sink
+	case logs.Format == FormatJSONMerge:
+		// The records are the ones of the process, with its own levels
+		output.logger = zap.New(zapcore.NewCore(encoder, sink, zap.DebugLevel))
+	default:
+		output.logger = zap.New(zapcore.NewCore(encoder, sink, zap.InfoLevel), zap.AddCaller())
+	}
+	outputLogs[path] = output
+	return output, nil
+}
+
+// Open the local logs of the stdout and stderr of a process
+func (logs Logs) open() (*outputLog, *outputLog, error) {
+	stdout, err := openOutputLog(logs.Stdout, logs)
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := openOutputLog(logs.Stderr, logs)
+	if err != nil {
+		stdout.close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+// Write a line of output as read, with its line feed
+func (output *outputLog) write(raw string) {
+	switch output.format {
+	case FormatRaw:
+		if output.timestamp {
+			raw = time.Now().Format(time.RFC3339Nano) + " " + raw
+		}
+		output.lock.Lock()
+		output.sink.Write([]byte(raw))
+		output.lock.Unlock()
+	case FormatJSONMerge:
+		output.writeMerged(trimLine(raw))
+	default:
+		output.logger.Info(trimLine(raw))
+	}
+}
+
+// Keys of the records written by zap which the fields of the process can not
+// use
+var reservedKeys = map[string]bool{
+	"level": true, "ts": true, "msg": true, "caller": true, "stacktrace": true, "logger": true,
+}
+
+// Levels of the process mapped to zap levels, a process never makes the
+// watchdog exit
+var childLevels = map[string]zapcore.Level{
+	"trace": zap.DebugLevel, "debug": zap.DebugLevel,
+	"info": zap.InfoLevel, "notice": zap.InfoLevel,
+	"warn": zap.WarnLevel, "warning": zap.WarnLevel,
+	"error": zap.ErrorLevel, "critical": zap.ErrorLevel, "fatal": zap.ErrorLevel, "panic": zap.ErrorLevel,
+}
+
+// Write a JSON object printed by the process as a record with its fields,
+// its msg or message is the message and its level the level of the record.
+// Fields named like the keys of zap are prefixed by child_.
+func (output *outputLog) writeMerged(line string) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") || decoder.Decode(&fields) != nil {
+		output.logger.Info(line)
+		return
+	}
+
+	message := ""
+	for _, key := range []string{"msg", "message"} {
+		if value, ok := fields[key].(string); ok {
+			message = value
+			delete(fields, key)
+			break
+		}
+	}
+	level := zap.InfoLevel
+	if value, ok := fields["level"].(string); ok {
+		if parsed, ok := childLevels[strings.ToLower(value)]; ok {
+			level = parsed
+			delete(fields, "level")
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	merged := make([]zap.Field, 0, len(keys))
+	for _, key := range keys {
+		name := key
+		if reservedKeys[key] {
+			name = "child_" + key
+		}
+		if number, ok := fields[key].(json.Number); ok {
+			// Written as the number printed, without losing precision
+			merged = append(merged, zap.Reflect(name, number))
+		} else {
+			merged = append(merged, zap.Any(name, fields[key]))
+		}
+	}
+	if entry := output.logger.Check(level, message); entry != nil {
+		entry.Write(merged...)
+	}
+}
+
+// Remove the line feed of a line
+func trimLine(raw string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r")
+}
+
+// Release the log, the file is closed once no instance write to it
+func (output *outputLog) close() {
+	outputLogsLock.Lock()
+	defer outputLogsLock.Unlock()
+	output.users--
+	if output.users > 0 {
+		return
+	}
+	delete(outputLogs, output.path)
+	if output.logger != nil {
+		output.logger.Sync()
+	} else {
+		output.sink.Sync()
+	}
+	if output.closeSink != nil {
+		output.closeSink()
+	}
+	if output.rotating != nil {
+		close(output.done)
+		output.rotating.Close()
+	}
+}
+
+// Create the rotating file of a local output
+func rotatingFile(path string, rotation Rotation) *lumberjack.Logger {
+	size := int64(rotation.MaxSize)
+	if size <= 0 {
+		size = defaultRotationSize
+	}
+	days := 0
+	if rotation.MaxAge > 0 {
+		days = int((time.Duration(rotation.MaxAge) + 24 * time.Hour - 1) / (24 * time.Hour))
+	}
+	return &lumberjack.Logger{
+		Filename: path,
+		// lumberjack count in megabytes
+		MaxSize: int((size + 1 << 20 - 1) >> 20),
+		MaxBackups: rotation.MaxBackups,
+		MaxAge: days,
+		Compress: rotation.Compress,
+	}
+}
+
+// Rotate the file at each interval until done is closed
+func rotateEvery(rotating *lumberjack.Logger, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rotating.Rotate()
+		case <-done:
+			return
+		}
+	}
+}
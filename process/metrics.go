@@ -0,0 +1,27 @@
+package process
+
+import (
+	"sync"
+)
+
+// Failed SSH connections per target name, guarded by dialErrorsLock
+var dialErrors = make(map[string]uint64)
+var dialErrorsLock sync.Mutex
+
+// Count a failed SSH connection to a target
+func countDialError(target string) {
+	dialErrorsLock.Lock()
+	defer dialErrorsLock.Unlock()
+	dialErrors[target]++
+}
+
+// SSHDialErrors return the number of failed SSH connections per target
+func SSHDialErrors() map[string]uint64 {
+	dialErrorsLock.Lock()
+	defer dialErrorsLock.Unlock()
+	counts := make(map[string]uint64)
+	for target, count := range dialErrors {
+		counts[target] = count
+	}
+	return counts
+}
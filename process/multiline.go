@@ -0,0 +1,133 @@
+package process
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multiline group consecutive lines of output in one record, such as the
+// lines of a stack trace
+type Multiline struct {
+	// A line matching start begins a record, the other lines continue it
+	Start string          `json:"start"`
+	// A line matching continuation is added to the current record, with a
+	// start pattern the other lines begin a record
+	Continuation string   `json:"continuation"`
+	// Time without new line after which the record is written (1s by default)
+	Timeout Duration      `json:"timeout"`
+	// Lines of a record at most (500 by default)
+	MaxLines int          `json:"max_lines"`
+}
+
+// Default flush timeout and size of the records
+const defaultMultilineTimeout = time.Second
+const defaultMultilineLines = 500
+
+// Validate return an error if the lines can not be grouped
+func (multiline Multiline) Validate() error {
+	if multiline.Start == "" && multiline.Continuation == "" {
+		return errors.New("Multiline require a start or a continuation pattern")
+	}
+	for _, pattern := range []string{multiline.Start, multiline.Continuation} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return errors.New("Invalid multiline pattern " + pattern)
+		}
+	}
+	if multiline.Timeout < 0 || multiline.MaxLines < 0 {
+		return errors.New("Multiline timeout and max_lines can not be negative")
+	}
+	return nil
+}
+
+// Lines of a record being grouped, written by emit
+type multilineGroup struct {
+	start *regexp.Regexp
+	continuation *regexp.Regexp
+	timeout time.Duration
+	maxLines int
+	emit func(string)
+
+	lock sync.Mutex
+	lines []string
+	last time.Time
+	timer *time.Timer
+}
+
+// Create the group of a validated rule
+func newMultilineGroup(multiline Multiline, emit func(string)) *multilineGroup {
+	group := &multilineGroup{
+		timeout: time.Duration(multiline.Timeout),
+		maxLines: multiline.MaxLines,
+		emit: emit,
+	}
+	if multiline.Start != "" {
+		group.start = regexp.MustCompile(multiline.Start)
+	}
+	if multiline.Continuation != "" {
+		group.continuation = regexp.MustCompile(multiline.Continuation)
+	}
+	if group.timeout <= 0 {
+		group.timeout = defaultMultilineTimeout
+	}
+	if group.maxLines <= 0 {
+		group.maxLines = defaultMultilineLines
+	}
+	return group
+}
+
+// Whether a line continue the current record
+func (group *multilineGroup) continues(line string) bool {
+	if group.start != nil && group.start.MatchString(line) {
+		return false
+	}
+	return group.continuation == nil || group.continuation.MatchString(line)
+}
+
+// Add a line read with its line feed, the current record is written when the
+// line begins another one
+func (group *multilineGroup) add(line string) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if len(group.lines) > 0 && (!group.continues(trimLine(line)) || len(group.lines) >= group.maxLines) {
+		group.write()
+	}
+	group.lines = append(group.lines, line)
+	group.last = time.Now()
+	if group.timer == nil {
+		group.timer = time.AfterFunc(group.timeout, group.expire)
+	} else {
+		group.timer.Reset(group.timeout)
+	}
+}
+
+// Write the record once no line was added for the timeout
+func (group *multilineGroup) expire() {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if time.Since(group.last) >= group.timeout {
+		group.write()
+	}
+}
+
+// Write the current record, guarded by lock
+func (group *multilineGroup) write() {
+	if len(group.lines) == 0 {
+		return
+	}
+	record := strings.Join(group.lines, "")
+	group.lines = nil
+	group.emit(record)
+}
+
+// Write the last record once the output is consumed
+func (group *multilineGroup) close() {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	if group.timer != nil {
+		group.timer.Stop()
+	}
+	group.write()
+}
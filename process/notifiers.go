@@ -0,0 +1,236 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Notifiers receiving the lifecycle events of the instances
+type Notifiers struct {
+	Webhooks []Webhook   `json:"webhooks"`
+	Emails []Email       `json:"emails"`
+}
+
+// Notification is an event sent to the notifiers
+type Notification struct {
+	Time time.Time       `json:"time"`
+	// started, crashed, restarted, fatal, health-failed, target-down...
+	Kind string          `json:"kind"`
+	Instance string      `json:"instance,omitempty"`
+	Process string       `json:"process,omitempty"`
+	Target string        `json:"target,omitempty"`
+	Message string       `json:"message"`
+	// Last records of output of a failed instance
+	Output []OutputLine  `json:"output,omitempty"`
+	// Notifications dropped by the deduplication or the rate limit since the
+	// previous one sent
+	Suppressed int       `json:"suppressed,omitempty"`
+}
+
+// NotifyFilter select the events sent by a notifier and limit how often they
+// are sent, so that an instance crashing in a loop does not flood it
+type NotifyFilter struct {
+	// Kinds of events sent, all by default
+	Events []string      `json:"events"`
+	// Processes whose events are sent, all by default. Events which are not
+	// about a process, such as target-down, are always sent.
+	Processes []string   `json:"processes"`
+	// Events of the same kind on the same instance or target are sent once
+	// within this window
+	Dedup Duration       `json:"dedup"`
+	// Notifications sent per minute at most
+	RateLimit int        `json:"rate_limit"`
+}
+
+// Notifications waiting to be sent per notifier
+const notifyQueue = 64
+
+// Validate return an error if the filter can not be applied
+func (filter NotifyFilter) Validate() error {
+	if filter.Dedup < 0 {
+		return errors.New("dedup can not be negative")
+	}
+	if filter.RateLimit < 0 {
+		return errors.New("rate_limit can not be negative")
+	}
+	return nil
+}
+
+// Functions available to the templates of the notifications
+var notifyFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// State of the filter of a notifier
+type notifyLimiter struct {
+	NotifyFilter
+	lock sync.Mutex
+	// Last notification sent by kind and instance or target
+	last map[string]time.Time
+	// Times of the notifications sent within the last minute
+	sent []time.Time
+	suppressed int
+}
+
+// Whether a notification is sent, in which case it carries the count of the
+// ones dropped before it
+func (limiter *notifyLimiter) admit(notification *Notification, now time.Time) bool {
+	if len(limiter.Events) > 0 && !contains(limiter.Events, notification.Kind) {
+		return false
+	}
+	if len(limiter.Processes) > 0 && notification.Process != "" &&
+		!contains(limiter.Processes, notification.Process) {
+		return false
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	key := notification.Kind + "\x00" + notification.Instance + "\x00" + notification.Target
+	if limiter.Dedup > 0 {
+		for previous, at := range limiter.last {
+			if now.Sub(at) >= time.Duration(limiter.Dedup) {
+				delete(limiter.last, previous)
+			}
+		}
+		if _, ok := limiter.last[key]; ok {
+			limiter.suppressed++
+			return false
+		}
+	}
+	if limiter.RateLimit > 0 {
+		kept := limiter.sent[:0]
+		for _, at := range limiter.sent {
+			if now.Sub(at) < time.Minute {
+				kept = append(kept, at)
+			}
+		}
+		limiter.sent = kept
+		if len(limiter.sent) >= limiter.RateLimit {
+			limiter.suppressed++
+			return false
+		}
+		limiter.sent = append(limiter.sent, now)
+	}
+	if limiter.Dedup > 0 {
+		limiter.last[key] = now
+	}
+	notification.Suppressed = limiter.suppressed
+	limiter.suppressed = 0
+	return true
+}
+
+// Whether value is one of values
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue of an open notifier, emptied by its own goroutine
+type notifierQueue struct {
+	limiter *notifyLimiter
+	notifications chan Notification
+	closing chan struct{}
+	stopped chan struct{}
+	// Logger of the notifications which could not be sent
+	logger *zap.Logger
+}
+
+// Create the queue of a notifier
+func newNotifierQueue(filter NotifyFilter, logger *zap.Logger) *notifierQueue {
+	return &notifierQueue{
+		limiter: &notifyLimiter{NotifyFilter: filter, last: make(map[string]time.Time)},
+		notifications: make(chan Notification, notifyQueue),
+		logger: logger,
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Open notifiers, guarded by notifiersLock
+var notifiers []*notifierQueue
+var notifiersLock sync.Mutex
+
+// OpenNotifiers start sending the notifications to the notifiers configured,
+// those which could not be sent are logged to logger
+func OpenNotifiers(config Notifiers, logger *zap.Logger) error {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	var opened []*notifierQueue
+	var runs []func()
+	for _, webhook := range config.Webhooks {
+		notifier, err := openWebhook(webhook, logger)
+		if err != nil {
+			return err
+		}
+		opened = append(opened, notifier.notifierQueue)
+		runs = append(runs, notifier.run)
+	}
+	for _, email := range config.Emails {
+		notifier, err := openEmail(email, logger)
+		if err != nil {
+			return err
+		}
+		opened = append(opened, notifier.notifierQueue)
+		runs = append(runs, notifier.run)
+	}
+
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	notifiers = append(notifiers, opened...)
+	for _, run := range runs {
+		go run()
+	}
+	return nil
+}
+
+// CloseNotifiers send the notifications queued within the timeout
+func CloseNotifiers(timeout time.Duration) {
+	notifiersLock.Lock()
+	closing := notifiers
+	notifiers = nil
+	notifiersLock.Unlock()
+
+	deadline := time.After(timeout)
+	for _, notifier := range closing {
+		close(notifier.closing)
+	}
+	for _, notifier := range closing {
+		select {
+		case <-notifier.stopped:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// Notify queue a notification on the notifiers whose filter admit it. It is
+// dropped when a queue is full rather than blocking the caller.
+func Notify(notification Notification) {
+	notifiersLock.Lock()
+	destinations := notifiers
+	notifiersLock.Unlock()
+	now := time.Now()
+	for _, notifier := range destinations {
+		admitted := notification
+		if !notifier.limiter.admit(&admitted, now) {
+			continue
+		}
+		select {
+		case notifier.notifications <- admitted:
+		default:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Socket receiving the sd_notify(3) messages of a local process
+type notifySocket struct {
+	dir string
+	connection *net.UnixConn
+}
+
+// Whether the process speak the notify protocol
+func (runtime Process) notifies() bool {
+	return runtime.NotifyWatchdog > 0 || (runtime.Readiness != nil && runtime.Readiness.Notify)
+}
+
+// Create the NOTIFY_SOCKET of an instance in a private directory
+func openNotifySocket() (*notifySocket, error) {
+	dir, err := ioutil.TempDir("", "watchdog-notify")
+	if err != nil {
+		return nil, err
+	}
+	address := &net.UnixAddr{Name: filepath.Join(dir, "notify.sock"), Net: "unixgram"}
+	connection, err := net.ListenUnixgram("unixgram", address)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &notifySocket{dir: dir, connection: connection}, nil
+}
+
+// Environment telling the process where to notify and how often to ping
+func (socket *notifySocket) environment(watchdog Duration) []string {
+	environment := []string{"NOTIFY_SOCKET=" + socket.connection.LocalAddr().String()}
+	if watchdog > 0 {
+		usec := time.Duration(watchdog) / time.Microsecond
+		environment = append(environment, "WATCHDOG_USEC=" + strconv.FormatInt(int64(usec), 10))
+	}
+	return environment
+}
+
+// Deliver the messages received to the state of the instance until closed
+func (socket *notifySocket) serve(state *instanceState) {
+	buffer := make([]byte, 4096)
+	for {
+		n, _, err := socket.connection.ReadFromUnix(buffer)
+		if err != nil {
+			return
+		}
+		state.notify(string(buffer[:n]))
+	}
+}
+
+// Close the socket and remove its directory
+func (socket *notifySocket) close() {
+	socket.connection.Close()
+	os.RemoveAll(socket.dir)
+}
+
+// Apply a notify message, newline separated KEY=VALUE assignments
+func (state *instanceState) notify(message string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	for _, line := range strings.Split(message, "\n") {
+		assignment := strings.SplitN(line, "=", 2)
+		if len(assignment) != 2 {
+			continue
+		}
+		switch assignment[0] {
+		case "READY":
+			if assignment[1] == "1" {
+				state.notifyReady = true
+			}
+		case "STATUS":
+			state.notifyStatus = assignment[1]
+		case "WATCHDOG":
+			if assignment[1] == "1" {
+				state.lastPing = time.Now()
+			} else if assignment[1] == "trigger" {
+				state.pingTriggered = true
+			}
+		}
+	}
+}
+
+// NotifyStatus return the last STATUS sent by the process on its NOTIFY_SOCKET
+func (process StartedProcess) NotifyStatus() string {
+	if process.state == nil {
+		return ""
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	return process.state.notifyStatus
+}
+
+// WatchNotify check the WATCHDOG=1 pings of the process. When none arrived
+// for timeout, or the process sent WATCHDOG=trigger, the instance is
+// UNHEALTHY and onHang is called with the reason, then the watch stops. It
+// also stops once the process ended or the instance is retired.
+func (process StartedProcess) WatchNotify(timeout Duration, onHang func(*StartedProcess, error) error) error {
+	if timeout <= 0 {
+		return errors.New("Watchdog timeout must be greater than 0")
+	}
+	if process.state == nil || !process.state.notifying {
+		return errors.New(process.ID + " has no NOTIFY_SOCKET")
+	}
+
+	ticker := time.NewTicker(time.Duration(timeout) / 4)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if process.unwatched() {
+				return
+			}
+			process.state.lock.Lock()
+			silence := time.Since(process.state.lastPing)
+			triggered := process.state.pingTriggered
+			process.state.lock.Unlock()
+
+			var reason error
+			if triggered {
+				reason = errors.New("Watchdog triggered by the process")
+			} else if silence > time.Duration(timeout) {
+				reason = fmt.Errorf("No watchdog ping for %s", silence.Round(time.Millisecond))
+			} else {
+				continue
+			}
+			process.state.set(StateUnhealthy)
+			onHang(&process, reason)
+			return
+		}
+	}()
+	return nil
+}
@@ -3,9 +3,9 @@ package process
 import (
 	"sync"
 	"go.uber.org/zap"
+	"os"
 	"os/exec"
 	"errors"
-	"bufio"
 	"golang.org/x/crypto/ssh"
 	"bytes"
 	"fmt"
@@ -13,7 +13,9 @@ import (
 	"syscall"
 	"time"
 	"strings"
+	"io"
 	"io/ioutil"
+	"net"
 )
 
 // Process define how to launch a processus
@@ -24,14 +26,50 @@ type Process struct {
 	Executable string   `json:"executable"`
 	Logs Logs           `json:"logs"`
 	Number int          `json:"number"`
+	// Account the process runs as on a remote target (sudo -u or su)
+	RunAs string        `json:"run_as"`
+	// Gain privileges through sudo rather than su (run_as defaults to root)
+	Sudo bool           `json:"sudo"`
+	HealthCheck *HealthCheck `json:"healthcheck"`
+	Readiness *Readiness     `json:"readiness"`
+	// Processes to start before this one, with the condition they must meet
+	// (started or ready)
+	DependsOn map[string]string `json:"depends_on"`
+	Hang *HangCheck          `json:"hang"`
+	// Longest time between two WATCHDOG=1 sent on NOTIFY_SOCKET by a local
+	// process before it is considered hung, exported as WATCHDOG_USEC
+	NotifyWatchdog Duration  `json:"notify_watchdog"`
+	// Limits on the resources used by each instance
+	Resources []ResourceRule `json:"resources"`
+	// Rules on the output of each instance
+	Alerts []AlertRule       `json:"alerts"`
 }
 // StartedProcess define a started process
 type StartedProcess struct {
-	Executable string `json:"executable`
+	// Identifier of the instance, stable across watchdog restarts
+	ID string         `json:"id"`
+	Executable string `json:"executable"`
 	Server Target     `json:"server"`
 	Pid int           `json:"pid"`
-	Logs Logs         `json:"logs`
+	Logs Logs         `json:"logs"`
 	Name string       `json:"name"`
+	RunAs string      `json:"run_as"`
+	Sudo bool         `json:"sudo"`
+	// Start time of the process in clock ticks since boot, as found in
+	// /proc/<pid>/stat, and its command line: with the PID they tell if a
+	// PID still belong to the process
+	StartTime uint64  `json:"start_time"`
+	Cmdline string    `json:"cmdline"`
+	// Executable the PID runs, as found in /proc/<pid>/exe
+	Exe string        `json:"exe"`
+	Started time.Time `json:"started"`
+	// How the process ended, set before onCrash is called when known
+	ExitStatus *ExitStatus `json:"exit_status,omitempty"`
+
+	// Completion of a process the watchdog is attached to (local or streamed)
+	exit *attachedExit
+	// Readiness and health of the instance
+	state *instanceState
 }
 // Target define where the process is started
 type Target struct {
@@ -40,6 +78,10 @@ type Target struct {
 	Name string     `json:"name"`
 	Port     int    `json:"port"`
 	Username string `json:"username"`
+	// Host entry of the OpenSSH client configuration used to fill empty fields
+	SSHConfigHost string `json:"ssh_config_host"`
+	// Comma separated list of [user@]host[:port] to hop through
+	ProxyJump string `json:"proxy_jump"`
 }
 // Auth define what's needed to connect to the Target
 type Auth struct {
@@ -50,55 +92,170 @@ type Auth struct {
 type Logs struct {
 	Stdout string `json:"stdout"`
 	Stderr string `json:"stderr"`
+	// "stream" pipe the output of remote processes back to local loggers,
+	// by default it is written to files on the target
+	Mode string   `json:"mode"`
+	// Rotation of the files written, on the watchdog host or on the target
+	Rotation *Rotation `json:"rotation"`
+	// Format of the output captured by the watchdog: json (default), raw or
+	// json-merge, and whether raw lines are prefixed by their time
+	Format string      `json:"format"`
+	Timestamp bool     `json:"timestamp"`
+	// Longest line captured (64KiB by default), the end of longer lines is
+	// replaced by a marker
+	MaxLineLength ByteSize `json:"max_line_length"`
+	// Group the lines of stack traces and other multiline messages
+	Multiline *Multiline   `json:"multiline"`
+	// Names of the sinks the output is forwarded to
+	Sinks []string         `json:"sinks"`
+	// Records of output kept in memory for the logs API and the crash events
+	// (500 by default)
+	Tail int               `json:"tail"`
 }
 
-// Create and Run a Process locally and return a startedProcess
+// Create and Run a Process locally and return a startedProcess as soon as it
+// is started, its ExitStatus is available through Status once it ends
 func RunProcess(executable, stdoutLogfile, stderrLogfile, name string, arguments... string) (StartedProcess, error) {
+	runtime := Process{
+		Name: name,
+		Arguments: arguments,
+		Target: "local",
+		Executable: executable,
+		Logs: Logs{
+			Stdout: stdoutLogfile,
+			Stderr: stderrLogfile,
+		},
+		Number: 1,
+	}
+	started, err := runtime.RunLocalProcess()
+	if err != nil {
+		return StartedProcess{}, err
+	}
+	return *started, nil
+}
+
+//------------------------------------------------------------------------------
+// Process type functions (non exported)
+//------------------------------------------------------------------------------
+
+// Validate return an error if the configuration of the process can not be run
+func (runtime Process) Validate() error {
+	if runtime.HealthCheck != nil {
+		if err := runtime.HealthCheck.Validate(); err != nil {
+			return err
+		}
+	}
+	if runtime.Readiness != nil {
+		if err := runtime.Readiness.Validate(); err != nil {
+			return err
+		}
+		if runtime.Readiness.LogRegex != "" && runtime.Target != "local" && runtime.Logs.Mode != StreamLogs {
+			return errors.New("log_regex readiness require the output of remote processes to be streamed")
+		}
+	}
+	if runtime.Hang != nil {
+		if err := runtime.Hang.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := runtime.Logs.Validate(); err != nil {
+		return err
+	}
+	if runtime.Target != "local" && runtime.Logs.Mode != StreamLogs &&
+		(runtime.Logs.Format == FormatJSON || runtime.Logs.Format == FormatJSONMerge || runtime.Logs.Timestamp ||
+		runtime.Logs.Multiline != nil || len(runtime.Logs.Sinks) > 0) {
+		return errors.New("Logs format, multiline and sinks of remote processes require their output to be streamed")
+	}
+	for _, rule := range runtime.Resources {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range runtime.Alerts {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(runtime.Alerts) > 0 && runtime.Target != "local" && runtime.Logs.Mode != StreamLogs {
+		return errors.New("Alerts on remote processes require their output to be streamed")
+	}
+	if runtime.notifies() && runtime.Target != "local" {
+		return errors.New("NOTIFY_SOCKET is only available to local processes")
+	}
+	return nil
+}
+
+// Run a Process on the watchdog host, see RunProcess
+func (runtime Process) RunLocalProcess() (*StartedProcess, error) {
 	var waiting sync.WaitGroup
-	var empty StartedProcess
-	stderrLogger, err := createLogger(stderrLogfile)
-	stdoutLogger, err := createLogger(stdoutLogfile)
-	command := exec.Command(executable, arguments...)
+	command := exec.Command(runtime.Executable, runtime.Arguments...)
 	stderr, err := command.StderrPipe()
 	if err != nil {
-		return empty, errors.New("CreateProcess() impossible to pipe stderr")
+		return nil, errors.New("CreateProcess() impossible to pipe stderr")
 	}
 	stdout, err := command.StdoutPipe()
 	if err != nil {
-		return empty, errors.New("CreateProcess() impossible to pipe stdout")
+		return nil, errors.New("CreateProcess() impossible to pipe stdout")
+	}
+	stdoutLog, stderrLog, err := runtime.Logs.open()
+	if err != nil {
+		return nil, errors.New("CreateProcess() impossible to create the loggers")
+	}
+
+	var socket *notifySocket
+	if runtime.notifies() {
+		socket, err = openNotifySocket()
+		if err != nil {
+			return nil, errors.New("CreateProcess() impossible to create the notify socket")
+		}
+		command.Env = append(os.Environ(), socket.environment(runtime.NotifyWatchdog)...)
 	}
 
 	if err := command.Start(); err != nil {
-		return empty, errors.New("CreateProcess() impossible to create the process")
+		if socket != nil {
+			socket.close()
+		}
+		stdoutLog.close()
+		stderrLog.close()
+		return nil, errors.New("CreateProcess() impossible to create the process")
 	}
 
+	state := newInstanceState(runtime.Readiness)
+	state.capturing = true
+	state.prepareCapture(runtime)
+	if socket != nil {
+		state.notifying = true
+		state.lastPing = time.Now()
+		go socket.serve(state)
+	}
 	waiting.Add(1)
 	go func(){
 		defer waiting.Done()
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			stdoutLogger.Info(scanner.Text())
-		}
+		logLines(stdout, stdoutLog, state.capture("stdout"))
 	}()
 
 	waiting.Add(1)
 	go func() {
 		defer waiting.Done()
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			stderrLogger.Info(scanner.Text())
-		}
+		logLines(stderr, stderrLog, state.capture("stderr"))
 	}()
 
-	if err := command.Wait(); err != nil {
-		//return empty, errors.New("CreateProcess() Failed to create process for " + executable)
-		return empty, err
-	}
-
-	waiting.Wait()
+	// The pipes must be drained before waiting for the process
+	exit := &attachedExit{done: make(chan struct{})}
+	go func() {
+		waiting.Wait()
+		command.Wait()
+		if socket != nil {
+			socket.close()
+		}
+		stdoutLog.close()
+		stderrLog.close()
+		exit.status = exitStatusOf(command.ProcessState)
+		close(exit.done)
+	}()
 
-	return StartedProcess {
-		Executable: executable,
+	started := &StartedProcess {
+		Executable: runtime.Executable,
 		Server: Target {
 			Auth: Auth{
 				Password: "",
@@ -110,79 +267,104 @@ func RunProcess(executable, stdoutLogfile, stderrLogfile, name string, arguments
 			Username: "",
 		},
 		Pid: command.Process.Pid,
-		Logs: Logs{
-			Stdout: stdoutLogfile,
-			Stderr: stderrLogfile,
-		},
-		Name: name,
-	}, nil
+		Logs: runtime.Logs,
+		Name: runtime.Name,
+		Started: time.Now(),
+		exit: exit,
+		state: state,
+	}
+	started.identify()
+	started.trackReadiness(runtime.Readiness)
+	return started, nil
 }
 
-//------------------------------------------------------------------------------
-// Process type functions (non exported)
-//------------------------------------------------------------------------------
-
 // Run a Process on a remote server
 func (runtime Process) RunRemoteProcess(server Target) (*StartedProcess, error) {
+	if runtime.Logs.Mode == StreamLogs {
+		return runtime.runStreamedProcess(server)
+	}
+
 	session, err := createSSHSession(server)
 	if err != nil {
 		return nil, errors.New("Failed to obtain an SSH session")
 	}
+	defer session.Close()
 
 	var buffer bytes.Buffer
 	session.Stdout = &buffer
 
 	// Create the command string
 	command := createCommand(runtime.Executable, runtime.Arguments, runtime.Logs)
+	command = wrapPrivilege(command, runtime.RunAs, runtime.Sudo)
 
 	err = session.Run(command)
 	if err != nil {
 		return nil, errors.New("Command : " + command + " : failed")
 	}
 
-	output := buffer.String()
-	pid, err := strconv.Atoi(output)
+	// The PID is the last word printed, login scripts may print before
+	output := strings.Fields(buffer.String())
+	if len(output) == 0 {
+		return nil, errors.New("Unexpected output")
+	}
+	pid, err := strconv.Atoi(output[len(output)-1])
 	if err != nil {
 		return nil, errors.New("Unexpected output")
 	}
 
-	return &StartedProcess{
+	started := &StartedProcess{
 		Executable: runtime.Executable,
 		Server: server,
 		Pid: pid,
-		Logs: Logs {
-			Stdout: runtime.Logs.Stdout,
-			Stderr: runtime.Logs.Stderr,
-		},
+		Logs: runtime.Logs,
 		Name: runtime.Name,
-	}, nil
+		RunAs: runtime.RunAs,
+		Sudo: runtime.Sudo,
+		Started: time.Now(),
+		state: newInstanceState(runtime.Readiness),
+	}
+	started.identify()
+	started.trackReadiness(runtime.Readiness)
+	return started, nil
 
 }
 //------------------------------------------------------------------------------
 // StartedProcess type functions
 //------------------------------------------------------------------------------
 
-// Send a signal to a specific process
+// Send a signal to a specific process. The signal is only delivered if the PID
+// still belong to the process, ErrPIDReused is returned otherwise.
 // TODO Get stdout and stderr
 func (process StartedProcess) Signal(signal syscall.Signal) error {
+	if process.exit != nil {
+		select {
+		case <-process.exit.done:
+			return ErrProcessEnded
+		default:
+		}
+	}
+
 	if process.Server.Name != "local" {
-		command := fmt.Sprintf("strace kill -s %d %d &> strace.log", signal, process.Pid)
+		command := guardCommand(process, fmt.Sprintf("strace kill -s %d %d &> strace.log", signal, process.Pid))
+		if process.RunAs != "" || process.Sudo {
+			// strace would drop the privileges of sudo, signal as the process owner
+			command = wrapPrivilege(guardCommand(process, fmt.Sprintf("kill -s %d %d", signal, process.Pid)),
+				process.RunAs, process.Sudo)
+		}
 		session, err := createSSHSession(process.Server)
 		if err != nil {
 			return errors.New("Failed to create SSH Session (send signal)")
 		}
+		defer session.Close()
 		err = session.Run(command)
-		if err != nil {
+		if exitError, ok := err.(*ssh.ExitError); ok && exitError.ExitStatus() == pidReusedCode {
+			return ErrPIDReused
+		} else if err != nil {
 			//return errors.New("Failed to Run command (send signal)")
 			return err
 		}
 	} else {
-		executable := "/bin/kill"
-		arguments := []string{"-s", signal.String(), strconv.Itoa(process.Pid)}
-		command := exec.Command(executable, arguments...)
-		if err := command.Start(); err != nil {
-			return errors.New("Failed to send signal")
-		}
+		return signalLocal(process, signal)
 	}
 	return nil
 }
@@ -202,7 +384,19 @@ func (process StartedProcess) Watch(frequency int, onTick func(StartedProcess) (
 		for {
 			select {
 			case <- ticker.C:
-				_, err := onTick(process)
+				if process.retired() {
+					ticker.Stop()
+					return
+				}
+				// A process which ended is reported once and no longer watched
+				status, err := process.Status()
+				if err == nil && status != nil {
+					process.ExitStatus = status
+					onCrash(&process)
+					ticker.Stop()
+					return
+				}
+				_, err = onTick(process)
 				if err != nil {
 					onCrash(&process)
 				}
@@ -223,6 +417,32 @@ func (process StartedProcess) Kill() error {
 // Utility functions (non exported)
 //------------------------------------------------------------------------------
 
+// Write every line read to the logger until the reader is closed, observe is
+// called with each line. Lines longer than the limit of the logs are truncated,
+// lines grouped by the multiline rule are written and observed as one record.
+func logLines(reader io.Reader, output *outputLog, observe func(string)) {
+	write := func(record string) {
+		output.write(record)
+		observe(trimLine(record))
+	}
+	if output.multiline != nil {
+		group := newMultilineGroup(*output.multiline, write)
+		defer group.close()
+		write = group.add
+	}
+
+	lines := newLineReader(reader, output.maxLineLength)
+	for {
+		line, err := lines.next()
+		if len(line) > 0 {
+			write(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 // Create a Logger writing to the path specified in parameter
 func createLogger(filepath string) (*zap.Logger, error) {
 	cfg := zap.NewProductionConfig()
@@ -234,36 +454,279 @@ func createLogger(filepath string) (*zap.Logger, error) {
 	return logger, nil
 }
 
-func createSSHSession(server Target) (*ssh.Session, error) {
-	var sshConfig ssh.ClientConfig
+// SSH session on a connection of its own, closing the session also close the
+// connection
+type sshSession struct {
+	*ssh.Session
+	connection *ssh.Client
+}
+
+// Close the session and its connection
+func (session *sshSession) Close() error {
+	session.Session.Close()
+	return session.connection.Close()
+}
+
+// Open a connection to the server and a session on it, the caller must Close
+// the session
+func createSSHSession(server Target) (*sshSession, error) {
+	connection, err := dialTarget(server)
+	if err != nil {
+		return nil, err
+	}
+	session, err := connection.NewSession()
+	if err != nil {
+		connection.Close()
+		return nil, errors.New("Impossible to establish the connection")
+	}
+
+	return &sshSession{Session: session, connection: connection}, nil
+}
+
+// Connections shared by the polls of the instances, by target. A connection is
+// forgotten once it is closed.
+var pollConnections = make(map[Target]*pollConnection)
+var pollConnectionsLock sync.Mutex
+
+// Connection to a target shared by the polls, usable once ready is closed
+type pollConnection struct {
+	ready chan struct{}
+	client *ssh.Client
+	err error
+}
+
+// Time given to a poll, its session is closed when it is exceeded
+var pollTimeout = 30 * time.Second
+
+// Run a short command on the connection to the server shared by the polls and
+// return its output. The connection is dialed again once when it broke.
+func runPoll(server Target, command string) (string, error) {
+	output, err := runPollOnce(server, command)
+	if err == errPollConnection {
+		output, err = runPollOnce(server, command)
+	}
+	if err == errPollConnection {
+		return "", errors.New("Impossible to establish the connection")
+	}
+	return output, err
+}
+
+// The shared connection could not open a session
+var errPollConnection = errors.New("SSH connection broken")
+
+// Output of a command run by a poll
+type pollResult struct {
+	output string
+	err error
+}
+
+// Run a command on the shared connection. The connection is closed when it can
+// not open a session anymore, a command which does not complete in time only
+// has its own session closed.
+func runPollOnce(server Target, command string) (string, error) {
+	connection, err := openPollConnection(server)
+	if err != nil {
+		return "", err
+	}
+
+	var lock sync.Mutex
+	var session *ssh.Session
+	timedOut := false
+	results := make(chan pollResult, 1)
+	go func() {
+		opened, err := connection.client.NewSession()
+		if _, rejected := err.(*ssh.OpenChannelError); rejected {
+			// Refused by the server, such as beyond its MaxSessions
+			results <- pollResult{err: err}
+			return
+		} else if err != nil {
+			connection.client.Close()
+			forgetPollConnection(server, connection)
+			results <- pollResult{err: errPollConnection}
+			return
+		}
+		lock.Lock()
+		if timedOut {
+			lock.Unlock()
+			opened.Close()
+			return
+		}
+		session = opened
+		lock.Unlock()
+		defer opened.Close()
+		var buffer bytes.Buffer
+		opened.Stdout = &buffer
+		err = opened.Run(command)
+		results <- pollResult{output: buffer.String(), err: err}
+	}()
+
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result.output, result.err
+	case <-timer.C:
+		lock.Lock()
+		timedOut = true
+		if session != nil {
+			session.Close()
+		}
+		lock.Unlock()
+		return "", errors.New("Poll of " + server.Name + " timed out")
+	}
+}
+
+// Return the connection to the server shared by the polls, dialing it when
+// there is none. It is dialed out of pollConnectionsLock so that an unreachable
+// target does not hold the polls of the others, the polls of the same target
+// wait for it.
+func openPollConnection(server Target) (*pollConnection, error) {
+	pollConnectionsLock.Lock()
+	connection, ok := pollConnections[server]
+	if !ok {
+		connection = &pollConnection{ready: make(chan struct{})}
+		pollConnections[server] = connection
+	}
+	pollConnectionsLock.Unlock()
+	if ok {
+		<-connection.ready
+		if connection.err != nil {
+			return nil, connection.err
+		}
+		return connection, nil
+	}
+
+	connection.client, connection.err = dialTarget(server)
+	close(connection.ready)
+	if connection.err != nil {
+		forgetPollConnection(server, connection)
+		return nil, connection.err
+	}
+	go func() {
+		connection.client.Wait()
+		forgetPollConnection(server, connection)
+	}()
+	return connection, nil
+}
+
+// Stop sharing a connection which is closed or could not be dialed
+func forgetPollConnection(server Target, connection *pollConnection) {
+	pollConnectionsLock.Lock()
+	defer pollConnectionsLock.Unlock()
+	if pollConnections[server] == connection {
+		delete(pollConnections, server)
+	}
+}
+
+// Open an SSH connection to the server, hopping through its ProxyJump hosts.
+// Failures are counted per target.
+func dialTarget(server Target) (*ssh.Client, error) {
+	connection, err := dialHops(server)
+	if err != nil {
+		countDialError(server.Name)
+	}
+	return connection, err
+}
+
+// Open an SSH connection to the server through each of its jump hosts. The
+// connections to the jump hosts are closed once the one to the server is.
+func dialHops(server Target) (*ssh.Client, error) {
+	server, err := server.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	hops, err := server.jumpHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections to the jump hosts, closed last to first
+	var opened []*ssh.Client
+	closeHops := func() {
+		for i := len(opened) - 1; i >= 0; i-- {
+			opened[i].Close()
+		}
+	}
+	var connection *ssh.Client
+	for _, hop := range append(hops, server) {
+		sshConfig, err := clientConfig(hop)
+		if err != nil {
+			closeHops()
+			return nil, err
+		}
+		address := net.JoinHostPort(hop.Hostname, strconv.Itoa(hop.Port))
+		if connection == nil {
+			connection, err = dialDirect(address, sshConfig)
+			if err != nil {
+				return nil, errors.New("Impossible to establish the connection")
+			}
+			continue
+		}
+		opened = append(opened, connection)
+		tunnel, err := connection.Dial("tcp", address)
+		if err != nil {
+			closeHops()
+			return nil, errors.New("Impossible to reach " + address + " through the jump host")
+		}
+		client, channels, requests, err := ssh.NewClientConn(tunnel, address, sshConfig)
+		if err != nil {
+			tunnel.Close()
+			closeHops()
+			return nil, errors.New("Impossible to establish the connection")
+		}
+		connection = ssh.NewClient(client, channels, requests)
+	}
+	if len(opened) > 0 {
+		go func() {
+			connection.Wait()
+			closeHops()
+		}()
+	}
+	return connection, nil
+}
+
+// Time given to establish the TCP connection to a target or a jump host, then
+// again to its SSH handshake
+const dialTimeout = 15 * time.Second
+
+// Open an SSH connection to an address reached directly, a server which
+// accepts the TCP connection but does not answer is given up after dialTimeout
+func dialDirect(address string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	tcp, err := net.DialTimeout("tcp", address, sshConfig.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	tcp.SetDeadline(time.Now().Add(dialTimeout))
+	client, channels, requests, err := ssh.NewClientConn(tcp, address, sshConfig)
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	tcp.SetDeadline(time.Time{})
+	return ssh.NewClient(client, channels, requests), nil
+}
+
+
+// Build the SSH client configuration matching the credentials of the server
+func clientConfig(server Target) (*ssh.ClientConfig, error) {
 	if server.Auth.PrivateKey == "" && server.Auth.Password != "" {
-		sshConfig = ssh.ClientConfig{
+		return &ssh.ClientConfig{
 			User: server.Username,
 			Auth: []ssh.AuthMethod{
 				ssh.Password(server.Auth.Password),
 			},
-		}
+			Timeout: dialTimeout,
+		}, nil
 	} else if server.Auth.Password == "" && server.Auth.PrivateKey != "" {
-		sshConfig = ssh.ClientConfig{
+		return &ssh.ClientConfig{
 			User: server.Username,
 			Auth: []ssh.AuthMethod{
 				publicKeyFile(server.Auth.PrivateKey),
 			},
-		}
-	} else {
-		return nil, errors.New("Incomplete credentials")
-	}
-
-	connection, err := ssh.Dial("tcp", "" + server.Hostname + ":" + strconv.Itoa(server.Port), &sshConfig)
-	if err != nil {
-		return nil, errors.New("Impossible to establish the connection")
+			Timeout: dialTimeout,
+		}, nil
 	}
-	session, err := connection.NewSession()
-	if err != nil {
-		return nil, errors.New("Impossible to establish the connection")
-	}
-
-	return session, nil
+	return nil, errors.New("Incomplete credentials")
 }
 
 func publicKeyFile(file string) ssh.AuthMethod {
@@ -280,13 +743,48 @@ func publicKeyFile(file string) ssh.AuthMethod {
 
 }
 
-// Create the command to run from given data
+// Create the command to run from given data. The command is started by a
+// detached wrapper shell which print the PID of the command, then wait for it
+// to record its exit status next to the logs (see statusFile).
 func createCommand(executable string, arguments []string, logs Logs) string {
 	args := strings.Join(arguments, " ")
-	command := fmt.Sprintf("nohup %s %s >> %s 2> %s & echo -n $!",
+	// Rotated files are truncated, stderr must be appended to so the process
+	// keeps writing at the end of the file
+	stderr := "2>"
+	if logs.Rotation != nil {
+		stderr = "2>>"
+	}
+	wrapper := fmt.Sprintf("%s %s >> %s %s %s & " +
+		"child=$!; printf %%s $child; exec > /dev/null; " +
+		"wait $child; code=$?; signal=; " +
+		"if [ $code -gt 128 ]; then signal=$(kill -l $((code - 128))); fi; " +
+		"echo $code $(date +%%s) $signal > %s",
 		executable,
 		args,
 		logs.Stdout,
-		logs.Stderr)
+		stderr,
+		logs.Stderr,
+		statusFile(logs, "$child"))
+	return "nohup sh -c " + shellQuote(wrapper) + " < /dev/null 2> /dev/null &"
+}
+
+// Wrap a shell command to run it as another user on the target. With sudo the
+// login user needs a passwordless sudo rule (-n never prompts), without it the
+// login user must be root to su to runAs.
+func wrapPrivilege(command string, runAs string, sudo bool) string {
+	if sudo {
+		wrapped := "sudo -n"
+		if runAs != "" {
+			wrapped += " -u " + shellQuote(runAs)
+		}
+		return wrapped + " sh -c " + shellQuote(command)
+	} else if runAs != "" {
+		return "su -s /bin/sh " + shellQuote(runAs) + " -c " + shellQuote(command)
+	}
 	return command
 }
+
+// Quote a string for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
@@ -2,10 +2,32 @@ package process
 
 import (
 	"testing"
+	"sync"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"reflect"
 	"syscall"
 	"os"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // -----------------------------------------------------------------------------
@@ -131,6 +153,44 @@ func TestRunRemoteProcess(t *testing.T) {
 		t.Errorf("Expected nil got %s", err.Error())
 	}
 }
+// The configuration of the logs is kept by a remote process, so that its files
+// are rotated on the target
+func TestRunRemoteProcessKeepRotation(t *testing.T) {
+	process := Process{
+		Name: "test",
+		Target: "null",
+		Executable: "/bin/ls",
+		Logs: Logs{
+			Stdout: "out.log",
+			Stderr: "err.log",
+			Rotation: &Rotation{MaxSize: 1},
+			Format: FormatRaw,
+		},
+		Number: 1,
+	}
+
+	target := Target{
+		Auth: Auth{
+			Password: "password",
+			PrivateKey: "",
+		},
+		Hostname: "localhost",
+		Name: "localhost",
+		Port: 10000,
+		Username: "root",
+	}
+
+	started, err := process.RunRemoteProcess(target)
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	if started.Logs.Rotation == nil || started.Logs.Rotation.MaxSize != 1 {
+		t.Errorf("Expected the rotation of the logs got %+v", started.Logs.Rotation)
+	}
+	if started.Logs.Format != FormatRaw {
+		t.Errorf("Expected format %s got %s", FormatRaw, started.Logs.Format)
+	}
+}
 // Test to run a remote process on a non existing server
 func TestRunRemoteProcessOnNonExistingServer(t *testing.T) {
 	dummyProcess := Process{
@@ -458,7 +518,11 @@ func TestCreateLogger1(t *testing.T) {
 // Test code related to createCommand
 // -----------------------------------------------------------------------------
 func TestCreateCommand(t *testing.T) {
-	expected := "nohup ls -l -a >> output 2> error & echo -n $!"
+	expected := "nohup sh -c 'ls -l -a >> output 2> error & " +
+		"child=$!; printf %s $child; exec > /dev/null; " +
+		"wait $child; code=$?; signal=; " +
+		"if [ $code -gt 128 ]; then signal=$(kill -l $((code - 128))); fi; " +
+		"echo $code $(date +%s) $signal > output.$child.status' < /dev/null 2> /dev/null &"
 	command := createCommand("ls", []string{"-l", "-a"}, Logs{
 		Stdout: "output",
 		Stderr: "error",
@@ -468,3 +532,2715 @@ func TestCreateCommand(t *testing.T) {
 		t.Errorf("Expected %s got %s", expected, command)
 	}
 }
+
+// -----------------------------------------------------------------------------
+// Test code related to ssh_config resolution
+// -----------------------------------------------------------------------------
+
+// Write a temporary ssh configuration and use it until the returned function is called
+func useSSHConfig(t *testing.T, content string) func() {
+	file, err := ioutil.TempFile("", "ssh_config")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	file.WriteString(content)
+	file.Close()
+
+	previous := sshConfigFiles
+	sshConfigFiles = []string{file.Name(), "i-do-not-exist.dne"}
+	return func() {
+		sshConfigFiles = previous
+		os.Remove(file.Name())
+	}
+}
+
+// Fields left empty are filled from the ssh configuration
+func TestResolveSSHConfigHost(t *testing.T) {
+	defer useSSHConfig(t, "Host web-1\n" +
+		"  HostName 10.0.0.1\n" +
+		"  Port 2222\n" +
+		"  User deploy\n" +
+		"  IdentityFile /keys/%r-%h\n" +
+		"  ProxyJump bastion\n")()
+
+	expected := Target{
+		Auth: Auth{
+			PrivateKey: "/keys/deploy-10.0.0.1",
+		},
+		Hostname: "10.0.0.1",
+		Name: "web",
+		Port: 2222,
+		Username: "deploy",
+		SSHConfigHost: "web-1",
+		ProxyJump: "bastion",
+	}
+
+	resolved, err := Target{Name: "web", SSHConfigHost: "web-1"}.Resolve()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if !reflect.DeepEqual(expected, resolved) {
+		t.Errorf("Expected %+v got %+v", expected, resolved)
+	}
+}
+
+// Explicit fields override the ssh configuration
+func TestResolveSSHConfigHostOverride(t *testing.T) {
+	defer useSSHConfig(t, "Host web-1\n" +
+		"  HostName 10.0.0.1\n" +
+		"  Port 2222\n" +
+		"  User deploy\n" +
+		"  IdentityFile /keys/deploy\n")()
+
+	target := Target{
+		Auth: Auth{
+			Password: "password",
+		},
+		Hostname: "localhost",
+		Port: 10000,
+		Username: "root",
+		SSHConfigHost: "web-1",
+	}
+
+	resolved, err := target.Resolve()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if !reflect.DeepEqual(target, resolved) {
+		t.Errorf("Expected %+v got %+v", target, resolved)
+	}
+}
+
+// Match blocks, which ssh_config can not parse, are left out of the
+// configuration and of the files it includes
+func TestResolveSSHConfigMatch(t *testing.T) {
+	directory, err := ioutil.TempDir("", "ssh_config")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	// Like the ssh_config.d/50-redhat.conf of Fedora and RHEL
+	ioutil.WriteFile(directory + "/50-redhat.conf", []byte("Port 2222\n" +
+		"Match final all\n" +
+		"  Include /etc/crypto-policies/back-ends/openssh.config\n" +
+		"  Port 1\n" +
+		"Host other\n" +
+		"  User other\n"), 0600)
+	defer useSSHConfig(t, "Match exec \"true\"\n" +
+		"  User nobody\n" +
+		"Host web-1\n" +
+		"  HostName 10.0.0.1\n" +
+		"  Include " + directory + "/*.conf\n" +
+		"  User deploy\n")()
+
+	resolved, err := Target{Name: "web", SSHConfigHost: "web-1"}.Resolve()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if resolved.Hostname != "10.0.0.1" || resolved.Port != 2222 || resolved.Username != "deploy" {
+		t.Errorf("Unexpected target %+v", resolved)
+	}
+}
+
+// ProxyJump hosts are resolved and inherit the credentials of the target
+func TestJumpHosts(t *testing.T) {
+	defer useSSHConfig(t, "Host bastion\n" +
+		"  HostName bastion.example.com\n" +
+		"  User jump\n")()
+
+	target := Target{
+		Auth: Auth{
+			Password: "password",
+		},
+		Hostname: "10.0.0.1",
+		Port: 22,
+		Username: "root",
+		ProxyJump: "bastion,admin@10.0.0.254:2200",
+	}
+
+	hops, err := target.jumpHosts()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if len(hops) != 2 {
+		t.Fatalf("Expected 2 hops got %d", len(hops))
+	}
+	if hops[0].Hostname != "bastion.example.com" || hops[0].Username != "jump" ||
+		hops[0].Port != 22 || hops[0].Auth != target.Auth {
+		t.Errorf("Unexpected first hop %+v", hops[0])
+	}
+	if hops[1].Hostname != "10.0.0.254" || hops[1].Username != "admin" || hops[1].Port != 2200 {
+		t.Errorf("Unexpected second hop %+v", hops[1])
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to wrapPrivilege
+// -----------------------------------------------------------------------------
+func TestWrapPrivilege(t *testing.T) {
+	command := "nohup ls -l -a >> output 2> error & echo -n $!"
+	cases := []struct {
+		runAs    string
+		sudo     bool
+		expected string
+	}{
+		{"", false, command},
+		{"", true, "sudo -n sh -c 'nohup ls -l -a >> output 2> error & echo -n $!'"},
+		{"app", true, "sudo -n -u 'app' sh -c 'nohup ls -l -a >> output 2> error & echo -n $!'"},
+		{"app", false, "su -s /bin/sh 'app' -c 'nohup ls -l -a >> output 2> error & echo -n $!'"},
+	}
+
+	for _, c := range cases {
+		wrapped := wrapPrivilege(command, c.runAs, c.sudo)
+		if wrapped != c.expected {
+			t.Errorf("Expected %s got %s", c.expected, wrapped)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	expected := `'it'\''s'`
+	quoted := shellQuote("it's")
+	if quoted != expected {
+		t.Errorf("Expected %s got %s", expected, quoted)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Status
+// -----------------------------------------------------------------------------
+
+// Wait until a local process ended and return its status
+func waitStatus(t *testing.T, started StartedProcess) *ExitStatus {
+	for i := 0; i < 100; i++ {
+		status, err := started.Status()
+		if err != nil {
+			t.Fatalf("Expected nil got %s", err.Error())
+		}
+		if status != nil {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Process %d did not end", started.Pid)
+	return nil
+}
+
+// A local process exiting with a code
+func TestStatusExitCode(t *testing.T) {
+	started, err := RunProcess("/bin/sh", "vms/logOut.log", "vms/logErr.err", "sh", "-c", "exit 3")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+
+	status := waitStatus(t, started)
+	if status.Code != 3 || status.Signal != "" {
+		t.Errorf("Expected code 3 got %+v", status)
+	}
+}
+
+// A local process terminated by a signal
+func TestStatusSignal(t *testing.T) {
+	started, err := RunProcess("/bin/sh", "vms/logOut.log", "vms/logErr.err", "sh", "-c", "kill -TERM $$")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+
+	status := waitStatus(t, started)
+	if status.Code != -1 || status.Signal != "SIGTERM" {
+		t.Errorf("Expected SIGTERM got %+v", status)
+	}
+}
+
+// Status files written by the remote wrapper
+func TestParseStatus(t *testing.T) {
+	status, err := parseStatus("")
+	if err != nil || status != nil {
+		t.Errorf("Expected nil, nil got %+v, %v", status, err)
+	}
+
+	status, err = parseStatus("3 1490184226\n")
+	if err != nil || status.Code != 3 || status.Signal != "" || status.Time.Unix() != 1490184226 {
+		t.Errorf("Expected code 3 got %+v, %v", status, err)
+	}
+
+	status, err = parseStatus("143 1490184226 TERM\n")
+	if err != nil || status.Code != -1 || status.Signal != "SIGTERM" {
+		t.Errorf("Expected SIGTERM got %+v, %v", status, err)
+	}
+
+	_, err = parseStatus("garbage")
+	if err == nil {
+		t.Errorf("Expected error got nil")
+	}
+}
+
+// The polls of remote instances share a connection per target, dialed again
+// once it is closed
+// (require SSHServer container to be up on port 10000)
+func TestRemoteStatusSharedConnection(t *testing.T) {
+	target := Target{
+		Auth: Auth{
+			Password: "password",
+		},
+		Hostname: "localhost",
+		Name: "localhost",
+		Port: 10000,
+		Username: "root",
+	}
+	started := StartedProcess{Server: target, Pid: 4242, Logs: Logs{Stdout: "out.log"}}
+
+	shared := func() *pollConnection {
+		pollConnectionsLock.Lock()
+		defer pollConnectionsLock.Unlock()
+		return pollConnections[target]
+	}
+	if _, err := started.Status(); err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	connection := shared()
+	for i := 0; i < 3; i++ {
+		if _, err := started.Status(); err != nil {
+			t.Fatalf("Expected nil got %s", err.Error())
+		}
+	}
+	if connection == nil || shared() != connection {
+		t.Fatalf("Expected the polls to share a connection")
+	}
+
+	connection.client.Close()
+	if _, err := started.Status(); err != nil {
+		t.Errorf("Expected nil after the connection closed got %s", err.Error())
+	}
+}
+
+// A poll which does not complete in time is ended without closing the
+// connection shared with the other polls
+// (require SSHServer container to be up on port 10000)
+func TestRemotePollTimeout(t *testing.T) {
+	target := Target{
+		Auth: Auth{
+			Password: "password",
+		},
+		Hostname: "localhost",
+		Name: "localhost",
+		Port: 10000,
+		Username: "root",
+	}
+	if _, err := runPoll(target, "true"); err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	pollConnectionsLock.Lock()
+	connection := pollConnections[target]
+	pollConnectionsLock.Unlock()
+
+	defer func(timeout time.Duration) { pollTimeout = timeout }(pollTimeout)
+	pollTimeout = 200 * time.Millisecond
+	if _, err := runPoll(target, "sleep 5"); err == nil {
+		t.Errorf("Expected the poll to time out")
+	}
+	output, err := runPoll(target, "echo done")
+	if err != nil || strings.TrimSpace(output) != "done" {
+		t.Errorf("Expected done got %q, %v", output, err)
+	}
+	pollConnectionsLock.Lock()
+	defer pollConnectionsLock.Unlock()
+	if pollConnections[target] != connection {
+		t.Errorf("Expected the connection to be kept")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to streamed remote processes
+// -----------------------------------------------------------------------------
+func TestCreateStreamCommand(t *testing.T) {
+	expected := "echo $$; exec ls -l -a"
+	command := createStreamCommand("ls", []string{"-l", "-a"})
+
+	if command != expected {
+		t.Errorf("Expected %s got %s", expected, command)
+	}
+}
+
+// A lost connection does not tell how the process ended
+func TestSessionExitStatus(t *testing.T) {
+	status := sessionExitStatus(nil)
+	if status.Code != 0 || status.Signal != "" {
+		t.Errorf("Expected code 0 got %+v", status)
+	}
+
+	status = sessionExitStatus(io.EOF)
+	if status.Code != -1 || status.Signal != "" {
+		t.Errorf("Expected code -1 got %+v", status)
+	}
+}
+
+// The process of a lost session is terminated
+func TestTerminateLost(t *testing.T) {
+	started, err := RunProcess("/bin/sleep", "vms/logOut.log", "vms/logErr.err", "sleep", "5")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+
+	terminateLost(started)
+	status := waitStatus(t, started)
+	if status.Signal != "SIGTERM" {
+		t.Errorf("Expected SIGTERM got %+v", status)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to process identity and state
+// -----------------------------------------------------------------------------
+func TestParseIdentity(t *testing.T) {
+	stat := "4242 (tail (x) y) S 1 4242 4242 0 -1 4194560 96 0 0 0 0 0 0 0 20 0 1 0 " +
+		"123456 8491008 179 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 1 0 0 0 0 0"
+	found, err := parseIdentity(stat, "/usr/bin/tail\x00-f\x00out.logs\x00", "/usr/bin/tail")
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if found.startTime != 123456 || found.cmdline != "/usr/bin/tail -f out.logs" ||
+		found.exe != "/usr/bin/tail" {
+		t.Errorf("Unexpected identity %+v", found)
+	}
+
+	_, err = parseIdentity("garbage", "", "")
+	if err == nil {
+		t.Errorf("Expected error got nil")
+	}
+}
+
+// A running local process is the same until it ends
+func TestIsSameProcess(t *testing.T) {
+	started, err := RunProcess("/bin/sleep", "vms/logOut.log", "vms/logErr.err", "sleep", "0.5")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	if started.StartTime == 0 || started.Cmdline != "/bin/sleep 0.5" {
+		t.Fatalf("Identity not recorded %+v", started)
+	}
+
+	same, err := started.IsSameProcess()
+	if err != nil || !same {
+		t.Errorf("Expected true got %t, %v", same, err)
+	}
+
+	waitStatus(t, started)
+	same, err = started.IsSameProcess()
+	if err != nil || same {
+		t.Errorf("Expected false got %t, %v", same, err)
+	}
+
+	started.StartTime++
+	same, _ = started.IsSameProcess()
+	if same {
+		t.Errorf("Expected false got true for another start time")
+	}
+}
+
+// A process which exec keeps its identity and can still be signaled
+func TestIsSameProcessExec(t *testing.T) {
+	started, err := RunProcess("/bin/sh", "vms/logOut.log", "vms/logErr.err", "sh", "-c", "sleep 0.2; exec sleep 5")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	same, err := started.IsSameProcess()
+	if err != nil || !same {
+		t.Errorf("Expected true got %t, %v", same, err)
+	}
+	// The start time decides over the executable
+	replaced := started
+	replaced.Exe = "/bin/i-do-not-exist"
+	same, err = replaced.IsSameProcess()
+	if err != nil || !same {
+		t.Errorf("Expected true got %t, %v", same, err)
+	}
+
+	if err := started.Kill(); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	status := waitStatus(t, started)
+	if status.Signal != "SIGTERM" {
+		t.Errorf("Expected SIGTERM got %+v", status)
+	}
+}
+
+// The executable of a deleted binary is the same as the one recorded
+func TestParseIdentityDeleted(t *testing.T) {
+	stat := "4242 (sleep) S" + strings.Repeat(" 0", 18) + " 123456 0"
+	found, err := parseIdentity(stat, "sleep\x005\x00", "/usr/bin/sleep (deleted)")
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if found.startTime != 123456 || found.exe != "/usr/bin/sleep" || found.cmdline != "sleep 5" {
+		t.Errorf("Unexpected identity %+v", found)
+	}
+}
+
+// Signals are not delivered to a PID which belong to another process
+func TestSignalPIDReused(t *testing.T) {
+	started, err := RunProcess("/bin/sleep", "vms/logOut.log", "vms/logErr.err", "sleep", "5")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer started.Kill()
+
+	reused := started
+	reused.StartTime++
+	reused.exit = nil
+	err = reused.Signal(syscall.SIGTERM)
+	if err != ErrPIDReused {
+		t.Errorf("Expected %v got %v", ErrPIDReused, err)
+	}
+
+	err = started.Kill()
+	if err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+	status := waitStatus(t, started)
+	if status.Signal != "SIGTERM" {
+		t.Errorf("Expected SIGTERM got %+v", status)
+	}
+
+	err = started.Kill()
+	if err != ErrProcessEnded {
+		t.Errorf("Expected %v got %v", ErrProcessEnded, err)
+	}
+}
+
+func TestGuardCommand(t *testing.T) {
+	started := StartedProcess{
+		Pid: 4242,
+		StartTime: 123456,
+		Exe: "/usr/bin/tail",
+	}
+
+	expected := `if [ "$(sed 's/.*) //' /proc/4242/stat 2> /dev/null | cut -d' ' -f20)" = 123456 ]; ` +
+		`then kill -s 15 4242; else exit 125; fi`
+	command := guardCommand(started, "kill -s 15 4242")
+	if command != expected {
+		t.Errorf("Expected %s got %s", expected, command)
+	}
+
+	started.StartTime = 0
+	command = guardCommand(started, "kill -s 15 4242")
+	if command != "kill -s 15 4242" {
+		t.Errorf("Expected unguarded command got %s", command)
+	}
+}
+
+// The state file keep the instances but not the credentials of their targets
+func TestSaveLoadState(t *testing.T) {
+	directory, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	path := directory + "/watchdog.state.json"
+
+	started := StartedProcess{
+		ID: "tail-0",
+		Executable: "/usr/bin/tail",
+		Server: Target{
+			Auth: Auth{
+				Password: "password",
+			},
+			Name: "ssh-1",
+		},
+		Pid: 4242,
+		Logs: Logs{
+			Stdout: "out.log",
+			Stderr: "err.log",
+		},
+		Name: "tail",
+		StartTime: 123456,
+		Cmdline: "/usr/bin/tail -f out.logs",
+		Started: time.Unix(1490184226, 0),
+	}
+	streamed := started
+	streamed.ID = "tail-1"
+	streamed.Logs.Mode = StreamLogs
+
+	if err := SaveState(path, []StartedProcess{started, streamed}); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+
+	if len(loaded) != 1 || !loaded[0].Started.Equal(started.Started) {
+		t.Fatalf("Expected [%+v] got %+v", started, loaded)
+	}
+	expected := started
+	expected.Server = Target{Name: "ssh-1"}
+	expected.Started = loaded[0].Started
+	expected.state = loaded[0].state
+	if loaded[0].State() != StateReady {
+		t.Errorf("Expected %s got %s", StateReady, loaded[0].State())
+	}
+	if !reflect.DeepEqual(expected, loaded[0]) {
+		t.Errorf("Expected [%+v] got %+v", expected, loaded)
+	}
+
+	loaded, err = LoadState(directory + "/i-do-not-exist.dne")
+	if err != nil || len(loaded) != 0 {
+		t.Errorf("Expected empty registry got %+v, %v", loaded, err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to health checks
+// -----------------------------------------------------------------------------
+func TestDurationUnmarshaling(t *testing.T) {
+	var durations struct {
+		Text Duration   `json:"text"`
+		Number Duration `json:"number"`
+	}
+	err := json.Unmarshal([]byte(`{"text": "1m30s", "number": 500}`), &durations)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if time.Duration(durations.Text) != 90 * time.Second ||
+		time.Duration(durations.Number) != 500 * time.Millisecond {
+		t.Errorf("Unexpected durations %+v", durations)
+	}
+
+	err = json.Unmarshal([]byte(`{"text": "forever"}`), &durations)
+	if err == nil {
+		t.Errorf("Expected error got nil")
+	}
+}
+
+func TestHealthCheckValidate(t *testing.T) {
+	invalid := []HealthCheck{
+		{Type: "smtp"},
+		{Type: "http"},
+		{Type: "http", URL: "http://localhost", BodyRegex: "("},
+		{Type: "tcp"},
+		{Type: "exec"},
+		{Type: "file", Path: "heartbeat"},
+	}
+	for _, check := range invalid {
+		if check.Validate() == nil {
+			t.Errorf("Expected error got nil for %+v", check)
+		}
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/health" {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writer.Write([]byte("status: ok"))
+	}))
+	defer server.Close()
+
+	check := HealthCheck{Type: "http", URL: server.URL + "/health", BodyRegex: "status: (ok|degraded)"}
+	if err := check.Probe(StartedProcess{}); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+
+	check.BodyRegex = "status: down"
+	if err := check.Probe(StartedProcess{}); err == nil {
+		t.Errorf("Expected error got nil for an unmatched body")
+	}
+
+	check = HealthCheck{Type: "http", URL: server.URL + "/other"}
+	if err := check.Probe(StartedProcess{}); err == nil {
+		t.Errorf("Expected error got nil for an unexpected status")
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	check := HealthCheck{Type: "tcp", Port: port}
+	local := StartedProcess{Server: Target{Hostname: "127.0.0.1"}}
+	if err := check.Probe(local); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+
+	listener.Close()
+	if err := check.Probe(local); err == nil {
+		t.Errorf("Expected error got nil once the port is closed")
+	}
+}
+
+func TestHealthCheckExec(t *testing.T) {
+	check := HealthCheck{Type: "exec", Command: []string{"/bin/sh", "-c", "exit 2"}, ExitCode: 2}
+	if err := check.Probe(StartedProcess{}); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+
+	check.ExitCode = 0
+	if err := check.Probe(StartedProcess{}); err == nil {
+		t.Errorf("Expected error got nil for an unexpected exit code")
+	}
+
+	check = HealthCheck{Type: "exec", Command: []string{"/bin/sleep", "1"}, Timeout: Duration(50 * time.Millisecond)}
+	if err := check.Probe(StartedProcess{}); err == nil {
+		t.Errorf("Expected error got nil for a command running past the timeout")
+	}
+}
+
+func TestHealthCheckFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "heartbeat")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	check := HealthCheck{Type: "file", Path: file.Name(), MaxAge: Duration(time.Minute)}
+	if err := check.Probe(StartedProcess{}); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(file.Name(), old, old)
+	if err := check.Probe(StartedProcess{}); err == nil {
+		t.Errorf("Expected error got nil for a stale file")
+	}
+}
+
+// onCrash is called once the failure threshold is reached
+func TestWatchHealthThreshold(t *testing.T) {
+	check := HealthCheck{
+		Type: "exec",
+		Command: []string{"/bin/false"},
+		Interval: Duration(10 * time.Millisecond),
+		Threshold: 3,
+	}
+	crashes := make(chan int, 10)
+	started := StartedProcess{ID: "false-0"}
+	err := started.WatchHealth(check, func(*StartedProcess) error {
+		crashes <- 1
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+
+	start := time.Now()
+	select {
+	case <-crashes:
+		if time.Since(start) < 30 * time.Millisecond {
+			t.Errorf("onCrash called before the threshold")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("onCrash not called")
+	}
+}
+
+// Commands probing a service from the target
+func TestHealthCheckTargetCommand(t *testing.T) {
+	cases := []struct {
+		check    HealthCheck
+		expected string
+	}{
+		{HealthCheck{Type: "http", URL: "http://127.0.0.1:8080/health"},
+			`curl -sS -m 5 -w '\n%{http_code}' 'http://127.0.0.1:8080/health'`},
+		{HealthCheck{Type: "tcp", Port: 5432},
+			`if command -v nc > /dev/null; then nc -z -w 5 '127.0.0.1' 5432; ` +
+			`else timeout 5 bash -c 'exec 3<> /dev/tcp/127.0.0.1/5432'; fi`},
+		{HealthCheck{Type: "exec", Command: []string{"pg_isready", "-d", "my db"}},
+			`timeout 5 'pg_isready' '-d' 'my db'`},
+		{HealthCheck{Type: "file", Path: "/run/app.heartbeat"},
+			`stat -c %Y '/run/app.heartbeat' && date +%s`},
+	}
+
+	for _, c := range cases {
+		command := c.check.targetCommand(4500 * time.Millisecond)
+		if command != c.expected {
+			t.Errorf("Expected %s got %s", c.expected, command)
+		}
+	}
+}
+
+func TestHealthCheckValidateFrom(t *testing.T) {
+	check := HealthCheck{Type: "exec", Command: []string{"true"}, From: FromTunnel}
+	if check.Validate() == nil {
+		t.Errorf("Expected error got nil for an exec check through a tunnel")
+	}
+	check.From = "elsewhere"
+	if check.Validate() == nil {
+		t.Errorf("Expected error got nil for an unknown origin")
+	}
+	check.From = FromTarget
+	if err := check.Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to readiness
+// -----------------------------------------------------------------------------
+
+// An instance without probes is ready as soon as it started
+func TestReadyWithoutProbes(t *testing.T) {
+	started, err := RunProcess("/bin/sleep", "vms/logOut.log", "vms/logErr.err", "sleep", "0.5")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	if started.State() != StateReady {
+		t.Errorf("Expected %s got %s", StateReady, started.State())
+	}
+	if err := started.WaitReady(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+}
+
+// The instance is ready once the regex matched its output
+func TestReadyOnLogRegex(t *testing.T) {
+	proc := Process{
+		Name: "ready",
+		Target: "local",
+		Executable: "/bin/sh",
+		Arguments: []string{"-c", "sleep 0.2; echo listening on 8080; sleep 1"},
+		Logs: Logs{
+			Stdout: "vms/logOut.log",
+			Stderr: "vms/logErr.err",
+		},
+		Readiness: &Readiness{
+			LogRegex: "listening on [0-9]+",
+			Interval: Duration(10 * time.Millisecond),
+		},
+	}
+	started, err := proc.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	if started.State() != StateStarting {
+		t.Errorf("Expected %s got %s", StateStarting, started.State())
+	}
+	if err := started.WaitReady(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+	if started.State() != StateReady {
+		t.Errorf("Expected %s got %s", StateReady, started.State())
+	}
+}
+
+// The instance is ready once its port accept connections, and unhealthy if
+// that takes longer than the timeout
+func TestReadyOnPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	proc := Process{
+		Name: "ready",
+		Target: "local",
+		Executable: "/bin/sleep",
+		Arguments: []string{"2"},
+		Logs: Logs{
+			Stdout: "vms/logOut.log",
+			Stderr: "vms/logErr.err",
+		},
+		Readiness: &Readiness{
+			Port: port,
+			Timeout: Duration(100 * time.Millisecond),
+			Interval: Duration(10 * time.Millisecond),
+		},
+	}
+	started, err := proc.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer started.Kill()
+	if err := started.WaitReady(); err == nil {
+		t.Errorf("Expected error got nil")
+	}
+	if started.State() != StateUnhealthy {
+		t.Errorf("Expected %s got %s", StateUnhealthy, started.State())
+	}
+
+	listener, err = net.Listen("tcp", "127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer listener.Close()
+	for i := 0; i < 100 && started.State() != StateReady; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if started.State() != StateReady {
+		t.Errorf("Expected %s got %s", StateReady, started.State())
+	}
+}
+
+func TestValidateReadiness(t *testing.T) {
+	proc := Process{
+		Name: "remote",
+		Target: "ssh-1",
+		Readiness: &Readiness{LogRegex: "ready"},
+	}
+	if proc.Validate() == nil {
+		t.Errorf("Expected error got nil for a log_regex on a remote file")
+	}
+	proc.Logs.Mode = StreamLogs
+	if err := proc.Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+	proc.Readiness = &Readiness{}
+	if proc.Validate() == nil {
+		t.Errorf("Expected error got nil for a readiness without probe")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to StartOrder
+// -----------------------------------------------------------------------------
+
+// Names of the processes in order
+func processNames(processes []Process) []string {
+	var names []string
+	for _, process := range processes {
+		names = append(names, process.Name)
+	}
+	return names
+}
+
+func TestStartOrder(t *testing.T) {
+	processes := []Process{
+		{Name: "app", DependsOn: map[string]string{"db": DependencyReady, "cache": ""}},
+		{Name: "worker", DependsOn: map[string]string{"app": DependencyStarted}},
+		{Name: "cache"},
+		{Name: "db"},
+		{Name: "cron"},
+	}
+
+	order, err := StartOrder(processes)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	expected := []string{"cache", "db", "cron", "app", "worker"}
+	if !reflect.DeepEqual(expected, processNames(order)) {
+		t.Errorf("Expected %v got %v", expected, processNames(order))
+	}
+}
+
+func TestStartOrderCycle(t *testing.T) {
+	processes := []Process{
+		{Name: "db"},
+		{Name: "app", DependsOn: map[string]string{"worker": ""}},
+		{Name: "worker", DependsOn: map[string]string{"app": ""}},
+	}
+
+	_, err := StartOrder(processes)
+	if err == nil || err.Error() != "Dependency cycle between app, worker" {
+		t.Errorf("Expected cycle error got %v", err)
+	}
+}
+
+func TestStartOrderInvalid(t *testing.T) {
+	_, err := StartOrder([]Process{{Name: "app", DependsOn: map[string]string{"db": ""}}})
+	if err == nil {
+		t.Errorf("Expected error got nil for an unknown dependency")
+	}
+
+	_, err = StartOrder([]Process{
+		{Name: "db"},
+		{Name: "app", DependsOn: map[string]string{"db": "healthy"}},
+	})
+	if err == nil {
+		t.Errorf("Expected error got nil for an unknown condition")
+	}
+
+	_, err = StartOrder([]Process{{Name: "db"}, {Name: "app"}, {Name: "db"}})
+	if err == nil || err.Error() != "Duplicate process name db" {
+		t.Errorf("Expected duplicate name error got %v", err)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to HangCheck
+// -----------------------------------------------------------------------------
+
+func TestHangCheckValidate(t *testing.T) {
+	valid := []HangCheck{
+		{Silence: Duration(time.Minute)},
+		{Heartbeat: "/tmp/heartbeat", HeartbeatMaxAge: Duration(time.Minute)},
+		{Silence: Duration(time.Minute), DiagnosticSignal: "SIGQUIT"},
+		{Silence: Duration(time.Minute), DiagnosticSignal: "usr1"},
+	}
+	for _, check := range valid {
+		if err := check.Validate(); err != nil {
+			t.Errorf("Expected nil got %s for %+v", err.Error(), check)
+		}
+	}
+
+	invalid := []HangCheck{
+		{},
+		{Heartbeat: "/tmp/heartbeat"},
+		{Silence: Duration(time.Minute), DiagnosticSignal: "SIGNOPE"},
+	}
+	for _, check := range invalid {
+		if err := check.Validate(); err == nil {
+			t.Errorf("Expected error got nil for %+v", check)
+		}
+	}
+}
+
+// A silent process receives the diagnostic signal before onHang is called
+func TestWatchHangSilence(t *testing.T) {
+	proc := Process{
+		Name: "silent",
+		Target: "local",
+		Executable: "/bin/sh",
+		Arguments: []string{"-c", "trap 'echo dump; exit 3' QUIT; echo started; while true; do sleep 0.01; done"},
+		Logs: Logs{
+			Stdout: "vms/logOut.log",
+			Stderr: "vms/logErr.err",
+		},
+	}
+	started, err := proc.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer started.Signal(syscall.SIGKILL)
+
+	check := HangCheck{
+		Silence: Duration(200 * time.Millisecond),
+		DiagnosticSignal: "SIGQUIT",
+		DiagnosticDelay: Duration(100 * time.Millisecond),
+		Interval: Duration(20 * time.Millisecond),
+	}
+	hangs := make(chan error, 10)
+	err = started.WatchHang(check, func(hung *StartedProcess, reason error) error {
+		hangs <- reason
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+
+	start := time.Now()
+	select {
+	case <-hangs:
+		if time.Since(start) < 200 * time.Millisecond {
+			t.Errorf("onHang called before the silence")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("onHang not called")
+	}
+	if started.State() != StateUnhealthy {
+		t.Errorf("Expected %s got %s", StateUnhealthy, started.State())
+	}
+	status := waitStatus(t, *started)
+	if status.Code != 3 {
+		t.Errorf("Expected the diagnostic signal to end the process got %+v", status)
+	}
+}
+
+// A stale heartbeat is a hang, a missing one only once the process is older
+// than the allowed age
+func TestWatchHangHeartbeat(t *testing.T) {
+	heartbeat, err := ioutil.TempFile("", "heartbeat")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	heartbeat.Close()
+	defer os.Remove(heartbeat.Name())
+
+	check := HangCheck{
+		Heartbeat: heartbeat.Name(),
+		HeartbeatMaxAge: Duration(time.Minute),
+	}
+	started := StartedProcess{ID: "beat-0", Server: Target{Name: "local"}, Started: time.Now()}
+	if reason := check.detect(started); reason != nil {
+		t.Errorf("Expected nil got %s", reason.Error())
+	}
+
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(heartbeat.Name(), old, old)
+	if reason := check.detect(started); reason != nil {
+		t.Errorf("Expected nil for a process younger than the max age got %s", reason.Error())
+	}
+	started.Started = old
+	if reason := check.detect(started); reason == nil {
+		t.Errorf("Expected a hang got nil")
+	}
+
+	check.Heartbeat = heartbeat.Name() + ".missing"
+	if reason := check.detect(started); reason == nil {
+		t.Errorf("Expected a hang for a missing heartbeat got nil")
+	}
+}
+
+// A retired instance is no longer watched
+func TestRetire(t *testing.T) {
+	check := HealthCheck{
+		Type: "exec",
+		Command: []string{"/bin/false"},
+		Interval: Duration(10 * time.Millisecond),
+		Threshold: 1,
+	}
+	crashes := make(chan int, 10)
+	started := StartedProcess{ID: "retired-0", state: newInstanceState(nil)}
+	started.Retire()
+	started.Retire()
+	err := started.WatchHealth(check, func(*StartedProcess) error {
+		crashes <- 1
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+
+	select {
+	case <-crashes:
+		t.Errorf("onCrash called on a retired instance")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseTimes(t *testing.T) {
+	times, err := parseTimes("1700000100\n1700000000\n")
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if len(times) != 2 || times[0].Unix() != 1700000100 || times[1].Unix() != 1700000000 {
+		t.Errorf("Unexpected times %v", times)
+	}
+	if _, err := parseTimes(""); err == nil {
+		t.Errorf("Expected error got nil")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to NOTIFY_SOCKET
+// -----------------------------------------------------------------------------
+
+// Start a local process writing its notify environment to a file and return
+// the socket it was given
+func startNotifying(t *testing.T, proc Process) (*StartedProcess, *net.UnixConn, []string) {
+	environment, err := ioutil.TempFile("", "notify-env")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	environment.Close()
+	defer os.Remove(environment.Name())
+
+	proc.Target = "local"
+	proc.Executable = "/bin/sh"
+	proc.Arguments = []string{"-c", "echo $NOTIFY_SOCKET $WATCHDOG_USEC > " + environment.Name() + "; sleep 5"}
+	proc.Logs = Logs{Stdout: "vms/logOut.log", Stderr: "vms/logErr.err"}
+	started, err := proc.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+
+	var fields []string
+	for i := 0; i < 100 && len(fields) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		content, _ := ioutil.ReadFile(environment.Name())
+		fields = strings.Fields(string(content))
+	}
+	if len(fields) == 0 {
+		started.Signal(syscall.SIGKILL)
+		t.Fatalf("NOTIFY_SOCKET not set")
+	}
+	socket, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: fields[0], Net: "unixgram"})
+	if err != nil {
+		started.Signal(syscall.SIGKILL)
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	return started, socket, fields
+}
+
+func TestNotifyReady(t *testing.T) {
+	started, socket, _ := startNotifying(t, Process{Name: "notify", Readiness: &Readiness{
+		Notify: true,
+		Interval: Duration(10 * time.Millisecond),
+	}})
+	defer started.Signal(syscall.SIGKILL)
+	defer socket.Close()
+
+	socket.Write([]byte("STATUS=warming up"))
+	time.Sleep(50 * time.Millisecond)
+	if started.State() != StateStarting {
+		t.Errorf("Expected %s got %s", StateStarting, started.State())
+	}
+	if started.NotifyStatus() != "warming up" {
+		t.Errorf("Expected warming up got %s", started.NotifyStatus())
+	}
+
+	socket.Write([]byte("READY=1\nSTATUS=serving"))
+	if err := started.WaitReady(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+	if started.NotifyStatus() != "serving" {
+		t.Errorf("Expected serving got %s", started.NotifyStatus())
+	}
+}
+
+func TestWatchNotify(t *testing.T) {
+	started, socket, environment := startNotifying(t, Process{
+		Name: "pinging",
+		NotifyWatchdog: Duration(200 * time.Millisecond),
+	})
+	defer started.Signal(syscall.SIGKILL)
+	defer socket.Close()
+	if len(environment) != 2 || environment[1] != "200000" {
+		t.Errorf("Expected WATCHDOG_USEC=200000 got %v", environment)
+	}
+
+	hangs := make(chan error, 10)
+	err := started.WatchNotify(Duration(200 * time.Millisecond), func(hung *StartedProcess, reason error) error {
+		hangs <- reason
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+
+	for i := 0; i < 6; i++ {
+		socket.Write([]byte("WATCHDOG=1"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case reason := <-hangs:
+		t.Errorf("onHang called while pinging: %s", reason.Error())
+	default:
+	}
+
+	select {
+	case <-hangs:
+		if started.State() != StateUnhealthy {
+			t.Errorf("Expected %s got %s", StateUnhealthy, started.State())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("onHang not called once the pings stopped")
+	}
+}
+
+// WATCHDOG=trigger is a hang at once, processes without socket can not be
+// watched
+func TestWatchNotifyTrigger(t *testing.T) {
+	started := StartedProcess{ID: "trigger-0", state: newInstanceState(nil)}
+	if err := started.WatchNotify(Duration(time.Second), nil); err == nil {
+		t.Errorf("Expected error got nil without NOTIFY_SOCKET")
+	}
+
+	started.state.notifying = true
+	started.state.lastPing = time.Now()
+	hangs := make(chan error, 10)
+	err := started.WatchNotify(Duration(200 * time.Millisecond), func(hung *StartedProcess, reason error) error {
+		hangs <- reason
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	started.state.notify("WATCHDOG=trigger")
+	select {
+	case reason := <-hangs:
+		if reason.Error() != "Watchdog triggered by the process" {
+			t.Errorf("Unexpected reason %s", reason.Error())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("onHang not called once triggered")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Usage
+// -----------------------------------------------------------------------------
+
+func TestParseUsage(t *testing.T) {
+	stat := "4242 (my (daemon)) S 1 4242 4242 0 -1 4194560 1200 0 0 0 250 50 0 0 20 0 7 0 123456 " +
+		"10000000 2000 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 3 0 0 0 0 0\n"
+	block := stat + "Name:\tdaemon\nVmRSS:\t  2048 kB\nThreads:\t7\n" +
+		"fds 12\nrchar: 100\nread_bytes: 4096\nwrite_bytes: 8192\n"
+
+	usage, err := parseUsage(StartedProcess{StartTime: 123456}, "1000.50 3000.00\n", block)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	expected := Usage{
+		Time: usage.Time,
+		RSS: 2048 * 1024,
+		FDs: 12,
+		Threads: 7,
+		ReadBytes: 4096,
+		WriteBytes: 8192,
+		ticks: 300,
+		uptime: 1000.5,
+	}
+	if !reflect.DeepEqual(expected, usage) {
+		t.Errorf("Expected %+v got %+v", expected, usage)
+	}
+
+	if _, err := parseUsage(StartedProcess{StartTime: 1}, "1000.50 3000.00\n", block); err != ErrPIDReused {
+		t.Errorf("Expected ErrPIDReused got %v", err)
+	}
+}
+
+// The CPU percent is computed between two samples and the history is bounded
+func TestRecordUsage(t *testing.T) {
+	state := newInstanceState(nil)
+	state.record(Usage{ticks: 1000, uptime: 100})
+	state.record(Usage{ticks: 1050, uptime: 101})
+	started := StartedProcess{state: state}
+	if usage := started.Usage(); usage == nil || usage.CPU != 50 {
+		t.Errorf("Expected 50%% CPU got %+v", usage)
+	}
+
+	for i := 0; i < usageHistory * 2; i++ {
+		state.record(Usage{ticks: 1050, uptime: float64(102 + i)})
+	}
+	history := started.UsageHistory()
+	if len(history) != usageHistory {
+		t.Errorf("Expected %d samples got %d", usageHistory, len(history))
+	}
+	if history[len(history) - 1].CPU != 0 {
+		t.Errorf("Expected 0%% CPU got %f", history[len(history) - 1].CPU)
+	}
+}
+
+func TestSampleUsageLocal(t *testing.T) {
+	proc := Process{
+		Name: "busy",
+		Target: "local",
+		Executable: "/bin/sh",
+		Arguments: []string{"-c", "while true; do :; done"},
+		Logs: Logs{
+			Stdout: "vms/logOut.log",
+			Stderr: "vms/logErr.err",
+		},
+	}
+	started, err := proc.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer started.Signal(syscall.SIGKILL)
+
+	for i := 0; i < 2; i++ {
+		if err := SampleUsage([]StartedProcess{*started}); err != nil {
+			t.Fatalf("Expected nil got %s", err.Error())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	usage := started.Usage()
+	if usage == nil {
+		t.Fatalf("Expected a sample got nil")
+	}
+	if usage.RSS == 0 || usage.Threads != 1 || usage.FDs < 3 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	if usage.CPU < 10 {
+		t.Errorf("Expected a busy process got %f%% CPU", usage.CPU)
+	}
+
+	started.Signal(syscall.SIGKILL)
+	waitStatus(t, *started)
+	if err := SampleUsage([]StartedProcess{*started}); err != nil {
+		t.Errorf("Expected nil for an ended process got %s", err.Error())
+	}
+	if len(started.UsageHistory()) != 2 {
+		t.Errorf("Expected 2 samples got %d", len(started.UsageHistory()))
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to ResourceRule
+// -----------------------------------------------------------------------------
+
+func TestResourceRuleUnmarshaling(t *testing.T) {
+	var rules []ResourceRule
+	err := json.Unmarshal([]byte(`[
+		{"max_rss": "2GiB", "for": "5m", "action": "restart"},
+		{"max_rss": "1.5 MB", "max_cpu": "95%"},
+		{"max_rss": 4096, "max_cpu": 50.5}
+	]`), &rules)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	expected := []ResourceRule{
+		{MaxRSS: 2 << 30, For: Duration(5 * time.Minute), Action: ActionRestart},
+		{MaxRSS: 1500000, MaxCPU: 95},
+		{MaxRSS: 4096, MaxCPU: 50.5},
+	}
+	if !reflect.DeepEqual(expected, rules) {
+		t.Errorf("Expected %+v got %+v", expected, rules)
+	}
+	if rules[0].String() != "rss > 2GiB for 5m0s" {
+		t.Errorf("Unexpected description %s", rules[0].String())
+	}
+
+	for _, invalid := range []string{`{"max_rss": "2 parsecs"}`, `{"max_rss": "GiB"}`, `{"max_cpu": "a lot"}`} {
+		var rule ResourceRule
+		if err := json.Unmarshal([]byte(invalid), &rule); err == nil {
+			t.Errorf("Expected error got nil for %s", invalid)
+		}
+	}
+}
+
+func TestResourceRuleValidate(t *testing.T) {
+	invalid := []ResourceRule{
+		{},
+		{MaxRSS: 1024, Action: "reboot"},
+	}
+	for _, rule := range invalid {
+		if rule.Validate() == nil {
+			t.Errorf("Expected error got nil for %+v", rule)
+		}
+	}
+	if err := (ResourceRule{MaxCPU: 90, Action: ActionKill}).Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+}
+
+// A rule triggers once every sample exceeded it for its duration, and is
+// evaluated again from the next sample
+func TestCheckResources(t *testing.T) {
+	rules := []ResourceRule{
+		{MaxRSS: 1000, For: Duration(time.Minute)},
+		{MaxCPU: 90},
+	}
+	started := StartedProcess{state: newInstanceState(nil)}
+	start := time.Now()
+	sample := func(offset time.Duration, rss uint64, ticks uint64) {
+		started.state.record(Usage{Time: start.Add(offset), RSS: rss, ticks: ticks,
+			uptime: offset.Seconds() + 1})
+	}
+
+	sample(0, 2000, 0)
+	sample(30 * time.Second, 500, 0)
+	if triggered := started.CheckResources(rules); len(triggered) != 0 {
+		t.Errorf("Expected no rule got %+v", triggered)
+	}
+	sample(40 * time.Second, 2000, 0)
+	sample(90 * time.Second, 2000, 0)
+	if triggered := started.CheckResources(rules); len(triggered) != 0 {
+		t.Errorf("Expected no rule got %+v", triggered)
+	}
+	sample(100 * time.Second, 2000, 1000)
+	triggered := started.CheckResources(rules)
+	if !reflect.DeepEqual(rules, triggered) {
+		t.Errorf("Expected %+v got %+v", rules, triggered)
+	}
+	if triggered := started.CheckResources(rules); len(triggered) != 0 {
+		t.Errorf("Expected no rule without new samples got %+v", triggered)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to metrics
+// -----------------------------------------------------------------------------
+
+func TestSSHDialErrors(t *testing.T) {
+	target := Target{
+		Name: "unreachable",
+		Hostname: "127.0.0.1",
+		Port: 1,
+		Username: "root",
+		Auth: Auth{Password: "root"},
+	}
+	before := SSHDialErrors()["unreachable"]
+	if _, err := createSSHSession(target); err == nil {
+		t.Fatalf("Expected error got nil")
+	}
+	if after := SSHDialErrors()["unreachable"]; after != before + 1 {
+		t.Errorf("Expected %d dial errors got %d", before + 1, after)
+	}
+}
+
+// An instance is down once its exit is known or it was not found by the
+// usage sampling
+func TestUp(t *testing.T) {
+	proc := Process{
+		Name: "short",
+		Target: "local",
+		Executable: "/bin/sh",
+		Arguments: []string{"-c", "exit 4"},
+		Logs: Logs{
+			Stdout: "vms/logOut.log",
+			Stderr: "vms/logErr.err",
+		},
+	}
+	started, err := proc.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	waitStatus(t, *started)
+	if started.Up() {
+		t.Errorf("Expected an ended process to be down")
+	}
+	if status := started.LastExit(); status == nil || status.Code != 4 {
+		t.Errorf("Expected exit code 4 got %+v", status)
+	}
+
+	adopted := StartedProcess{ID: "adopted-0", Server: Target{Name: "local"}, Pid: started.Pid,
+		state: newInstanceState(nil)}
+	if !adopted.Up() {
+		t.Errorf("Expected an adopted process to be up until sampled")
+	}
+	SampleUsage([]StartedProcess{adopted})
+	if adopted.Up() {
+		t.Errorf("Expected a process not found to be down")
+	}
+}
+
+func TestHealthStats(t *testing.T) {
+	check := HealthCheck{
+		Type: "exec",
+		Command: []string{"/bin/false"},
+		Interval: Duration(10 * time.Millisecond),
+		Threshold: 100,
+	}
+	started := StartedProcess{ID: "stats-0", state: newInstanceState(nil)}
+	if started.HealthStats() != nil {
+		t.Errorf("Expected nil before the first probe")
+	}
+	if err := started.WatchHealth(check, func(*StartedProcess) error { return nil }); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	started.Retire()
+
+	stats := started.HealthStats()
+	if stats == nil || stats.Probes == 0 || stats.Failures != stats.Probes || stats.Healthy || stats.Latency <= 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Rotation
+// -----------------------------------------------------------------------------
+
+// Local files are rotated by size and shared by the instances of a process
+func TestOutputLogRotation(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	path := directory + "/out.log"
+
+	logs := Logs{Rotation: &Rotation{MaxSize: 1}}
+	output, err := openOutputLog(path, logs)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	shared, err := openOutputLog(path, logs)
+	if err != nil || shared != output {
+		t.Errorf("Expected the instances to share the log")
+	}
+	line := strings.Repeat("x", 1024)
+	for i := 0; i < 1100; i++ {
+		output.write(line)
+	}
+	output.close()
+	shared.close()
+
+	backups, _ := filepath.Glob(directory + "/out-*.log")
+	if len(backups) != 1 {
+		t.Errorf("Expected 1 rotated file got %v", backups)
+	}
+	if _, ok := outputLogs[path]; ok {
+		t.Errorf("Expected the log to be closed")
+	}
+}
+
+// The remote rotation command is run by a local shell
+func TestRotateCommand(t *testing.T) {
+	directory, err := ioutil.TempDir("", "rotation")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+	logs := Logs{
+		Stdout: directory + "/out.log",
+		Stderr: directory + "/out.log",
+		Rotation: &Rotation{MaxSize: 100, MaxBackups: 2, MaxAge: Duration(time.Hour), Compress: true},
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"out-2000-01-01T00-00-00.000.log.gz", "out-2000-01-02T00-00-00.000.log.gz"} {
+		ioutil.WriteFile(directory + "/" + name, nil, 0644)
+		os.Chtimes(directory + "/" + name, old, old)
+	}
+	ioutil.WriteFile(directory + "/out-2000-01-03T00-00-00.000.log.gz", nil, 0644)
+	ioutil.WriteFile(directory + "/out.log.42.status", nil, 0644)
+	// Log of another service sharing the prefix
+	ioutil.WriteFile(directory + "/out-worker.log", nil, 0644)
+	os.Chtimes(directory + "/out-worker.log", old, old)
+	ioutil.WriteFile(logs.Stdout, []byte("small\n"), 0644)
+
+	run := func(force bool) {
+		output, err := exec.Command("/bin/sh", "-c", rotateCommand(logs, force)).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Expected nil got %s: %s", err.Error(), output)
+		}
+	}
+	run(false)
+	if content, _ := ioutil.ReadFile(logs.Stdout); string(content) != "small\n" {
+		t.Errorf("Expected a file under max_size to be kept got %q", content)
+	}
+
+	run(true)
+	if content, _ := ioutil.ReadFile(logs.Stdout); len(content) != 0 {
+		t.Errorf("Expected the file to be truncated got %q", content)
+	}
+	backups, _ := filepath.Glob(directory + "/out-2???-*.log*")
+	if len(backups) != 2 {
+		t.Errorf("Expected 2 rotated files got %v", backups)
+	}
+	compressed, _ := filepath.Glob(directory + "/out-2???-*.log.gz")
+	if len(compressed) != 2 || strings.Contains(strings.Join(backups, " "), "2000-01-01") {
+		t.Errorf("Expected the new compressed file and the recent one got %v", backups)
+	}
+	if _, err := os.Stat(directory + "/out.log.42.status"); err != nil {
+		t.Errorf("Expected the status file to be kept")
+	}
+	if _, err := os.Stat(directory + "/out-worker.log"); err != nil {
+		t.Errorf("Expected the log of another service to be kept")
+	}
+}
+
+func TestCreateCommandRotation(t *testing.T) {
+	command := createCommand("ls", nil, Logs{Stdout: "out.log", Stderr: "err.log", Rotation: &Rotation{}})
+	if !strings.Contains(command, ">> out.log 2>> err.log &") {
+		t.Errorf("Expected stderr to be appended to got %s", command)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to logs format
+// -----------------------------------------------------------------------------
+
+// Raw lines are written as read, including a missing final line feed
+func TestOutputLogRaw(t *testing.T) {
+	directory, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	output, err := openOutputLog(directory + "/out.log", Logs{Format: FormatRaw})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	logLines(strings.NewReader("first\r\n\tsecond \nlast"), output, func(string) {})
+	output.close()
+	content, _ := ioutil.ReadFile(directory + "/out.log")
+	if string(content) != "first\r\n\tsecond \nlast" {
+		t.Errorf("Expected the output unchanged got %q", content)
+	}
+
+	output, _ = openOutputLog(directory + "/stamped.log", Logs{Format: FormatRaw, Timestamp: true})
+	output.write("line\n")
+	output.close()
+	content, _ = ioutil.ReadFile(directory + "/stamped.log")
+	fields := strings.SplitN(string(content), " ", 2)
+	if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil || fields[1] != "line\n" {
+		t.Errorf("Expected a timestamped line got %q", content)
+	}
+}
+
+// JSON lines of the process become the fields of the record
+func TestOutputLogJSONMerge(t *testing.T) {
+	directory, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	output, err := openOutputLog(directory + "/out.log", Logs{Format: FormatJSONMerge})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	output.write(`{"level":"warning","message":"disk low","free":12345678901234,"ts":"yesterday","user":{"id":1}}` + "\n")
+	output.write("not json\n")
+	output.close()
+
+	content, _ := ioutil.ReadFile(directory + "/out.log")
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records got %q", content)
+	}
+	var merged map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(lines[0]))
+	decoder.UseNumber()
+	if err := decoder.Decode(&merged); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if merged["level"] != "warn" || merged["msg"] != "disk low" || merged["child_ts"] != "yesterday" ||
+		merged["free"] != json.Number("12345678901234") || merged["user"] == nil {
+		t.Errorf("Unexpected record %s", lines[0])
+	}
+	if _, ok := merged["message"]; ok {
+		t.Errorf("Expected message to be the msg got %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"msg":"not json"`) {
+		t.Errorf("Expected the line to be the message got %s", lines[1])
+	}
+}
+
+func TestLogsValidate(t *testing.T) {
+	for _, logs := range []Logs{{Format: "text"}, {Format: FormatJSON, Timestamp: true}} {
+		if logs.Validate() == nil {
+			t.Errorf("Expected an error for %+v", logs)
+		}
+	}
+	if err := (Logs{Format: FormatRaw, Timestamp: true}).Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to lineReader
+// -----------------------------------------------------------------------------
+
+func TestLineReaderTruncate(t *testing.T) {
+	long := strings.Repeat("x", 100) + "é" + strings.Repeat("y", 200)
+	lines := newLineReader(strings.NewReader(long + "\nshort\n" + strings.Repeat("z", 250)), 101)
+
+	var read []string
+	for {
+		line, err := lines.next()
+		if len(line) > 0 {
+			read = append(read, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	expected := []string{
+		strings.Repeat("x", 100) + truncatedMarker(202) + "\n",
+		"short\n",
+		strings.Repeat("z", 101) + truncatedMarker(149),
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("Expected %q got %q", expected, read)
+	}
+}
+
+// A process printing megabytes of binary output without line feed is not
+// blocked and its JSON log stays valid
+func TestLogLinesBinary(t *testing.T) {
+	directory, err := ioutil.TempDir("", "lines")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	processus := Process{
+		Name: "binary",
+		Target: "local",
+		Executable: "sh",
+		Arguments: []string{"-c", "head -c 3000000 /dev/urandom | tr -d '\\n'; printf '\\n\\377\\376 end\\n'"},
+		Logs: Logs{Stdout: directory + "/out.log", Stderr: directory + "/err.log"},
+	}
+	started, err := processus.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	waitStatus(t, *started)
+
+	content, _ := ioutil.ReadFile(directory + "/out.log")
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	for _, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected valid JSON got %s", err.Error())
+		}
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], "[truncated ") || !strings.Contains(lines[1], `\ufffd\ufffd end"`) {
+		t.Errorf("Expected a truncated line and an escaped one got %d lines", len(lines))
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Multiline
+// -----------------------------------------------------------------------------
+
+// Read the records written by a multiline group from the output
+func groupLines(multiline Multiline, output string) []string {
+	var records []string
+	var lock sync.Mutex
+	group := newMultilineGroup(multiline, func(record string) {
+		lock.Lock()
+		records = append(records, record)
+		lock.Unlock()
+	})
+	lines := newLineReader(strings.NewReader(output), 0)
+	for {
+		line, err := lines.next()
+		if len(line) > 0 {
+			group.add(line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	group.close()
+	return records
+}
+
+// A Java stack trace where records begin with a timestamp
+func TestMultilineStart(t *testing.T) {
+	output := "2024-01-01 ERROR failed\njava.lang.NullPointerException\n\tat A.b(A.java:1)\n\tat A.c(A.java:2)\n" +
+		"2024-01-01 INFO next\n"
+	records := groupLines(Multiline{Start: `^\d{4}-`}, output)
+	expected := []string{
+		"2024-01-01 ERROR failed\njava.lang.NullPointerException\n\tat A.b(A.java:1)\n\tat A.c(A.java:2)\n",
+		"2024-01-01 INFO next\n",
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %q got %q", expected, records)
+	}
+}
+
+// A Python traceback where indented lines continue the record
+func TestMultilineContinuation(t *testing.T) {
+	output := "Traceback (most recent call last):\n  File \"a.py\", line 1\n    main()\nValueError: bad\nnext\n"
+	records := groupLines(Multiline{Start: `^Traceback`, Continuation: `^\s`}, output)
+	expected := []string{
+		"Traceback (most recent call last):\n  File \"a.py\", line 1\n    main()\n",
+		"ValueError: bad\n",
+		"next\n",
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %q got %q", expected, records)
+	}
+
+	records = groupLines(Multiline{Continuation: `^\s`, MaxLines: 2}, "a\n b\n c\n")
+	if !reflect.DeepEqual(records, []string{"a\n b\n", " c\n"}) {
+		t.Errorf("Expected records of 2 lines got %q", records)
+	}
+}
+
+// A record is written once no line was added for the timeout
+func TestMultilineTimeout(t *testing.T) {
+	written := make(chan string, 1)
+	group := newMultilineGroup(Multiline{Continuation: `^\s`, Timeout: Duration(50 * time.Millisecond)},
+		func(record string) { written <- record })
+	group.add("error\n")
+	group.add("  detail\n")
+	select {
+	case record := <-written:
+		if record != "error\n  detail\n" {
+			t.Errorf("Unexpected record %q", record)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the record to be written")
+	}
+	group.close()
+}
+
+func TestMultilineValidate(t *testing.T) {
+	for _, multiline := range []Multiline{{}, {Start: "("}, {Start: "^a", MaxLines: -1}} {
+		if (Logs{Multiline: &multiline}).Validate() == nil {
+			t.Errorf("Expected an error for %+v", multiline)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Sink
+// -----------------------------------------------------------------------------
+
+// The output of an instance is forwarded as JSON records with its tags
+func TestSinkJSON(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer listener.Close()
+	directory, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(directory)
+	err = OpenSinks([]Sink{{Name: "json", Type: SinkJSON, Network: "tcp", Address: listener.Addr().String(),
+		Buffer: directory + "/json.buffer"}})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	defer CloseSinks(time.Second)
+
+	processus := Process{
+		Name: "forwarded",
+		Target: "local",
+		Executable: "sh",
+		Arguments: []string{"-c", "sleep 0.2; echo hello; echo failed >&2"},
+		Logs: Logs{Stdout: directory + "/out.log", Stderr: directory + "/err.log", Sinks: []string{"json"}},
+	}
+	started, err := processus.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	started.SetID("forwarded-0")
+
+	connection, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer connection.Close()
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(connection)
+	records := make(map[string]sinkRecord)
+	for i := 0; i < 2; i++ {
+		var record sinkRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("Expected nil got %s", err.Error())
+		}
+		records[record.Stream] = record
+	}
+	stdout := records["stdout"]
+	if stdout.Message != "hello" || stdout.Process != "forwarded" || stdout.Instance != "forwarded-0" ||
+		stdout.Target != "local" || stdout.Severity != severityInfo {
+		t.Errorf("Unexpected record %+v", stdout)
+	}
+	if records["stderr"].Message != "failed" || records["stderr"].Severity != severityError {
+		t.Errorf("Unexpected record %+v", records["stderr"])
+	}
+}
+
+// The watchdog log is sent as RFC 5424 messages
+func TestSinkSyslog(t *testing.T) {
+	connection, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer connection.Close()
+	directory, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(directory)
+	err = OpenSinks([]Sink{{Name: "syslog", Type: SinkSyslog, Network: "udp", Address: connection.LocalAddr().String(),
+		Facility: "local0", Buffer: directory + "/syslog.buffer"}})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	defer CloseSinks(time.Second)
+
+	core, err := SinkCore([]string{"syslog"}, zap.InfoLevel)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	logger := zap.New(core)
+	logger.Debug("ignored")
+	logger.Warn("Instance not ready", zap.String("instance", "web-0"))
+
+	buffer := make([]byte, 4096)
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := connection.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	message := string(buffer[:n])
+	expected := regexp.MustCompile(`^<132>1 \S+Z \S+ watchdog - log \[watchdog@32473 process="watchdog"\] ` +
+		`Instance not ready \{"instance":"web-0"\}$`)
+	if !expected.MatchString(message) {
+		t.Errorf("Unexpected message %s", message)
+	}
+}
+
+// Records are buffered while the server is down and sent once it is back
+func TestSinkBuffer(t *testing.T) {
+	retry := sinkRetryInterval
+	sinkRetryInterval = 50 * time.Millisecond
+	defer func() { sinkRetryInterval = retry }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	directory, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(directory)
+	buffer := directory + "/down.buffer"
+	err = OpenSinks([]Sink{{Name: "down", Type: SinkJSON, Network: "tcp", Address: address, Buffer: buffer}})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	defer CloseSinks(time.Second)
+
+	sink := lookupSinks([]string{"down"})[0]
+	for _, message := range []string{"first", "second"} {
+		sink.send(sinkRecord{Time: time.Now(), Process: "p", Stream: "stdout", Message: message})
+	}
+	for i := 0; i < 50; i++ {
+		if content, _ := ioutil.ReadFile(buffer); strings.Count(string(content), "\n") == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer listener.Close()
+	connection, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	defer connection.Close()
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	decoder := json.NewDecoder(connection)
+	for _, message := range []string{"first", "second"} {
+		var record sinkRecord
+		if err := decoder.Decode(&record); err != nil || record.Message != message {
+			t.Fatalf("Expected %s got %+v %v", message, record, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if info, err := os.Stat(buffer); err == nil && info.Size() == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Expected the buffer to be emptied")
+}
+
+// Records are buffered rather than dropped when the queue is full
+func TestSinkOverflow(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(directory)
+	sink := &logSink{
+		Sink: Sink{Name: "slow", Type: SinkJSON, Buffer: directory + "/slow.buffer", MaxBuffer: defaultMaxBuffer},
+		records: make(chan sinkRecord, 1),
+		closing: make(chan struct{}),
+	}
+	for _, message := range []string{"queued", "first", "second"} {
+		sink.send(sinkRecord{Time: time.Now(), Process: "p", Stream: "stdout", Message: message})
+	}
+
+	if record := <-sink.records; record.Message != "queued" {
+		t.Errorf("Expected queued got %s", record.Message)
+	}
+	content, _ := ioutil.ReadFile(sink.Buffer)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"first"`) || !strings.Contains(lines[1], `"second"`) ||
+		!sink.pending() {
+		t.Errorf("Expected the records beyond the queue in the buffer got %q", content)
+	}
+}
+
+func TestSinkValidate(t *testing.T) {
+	invalid := []Sink{
+		{Name: "a", Type: SinkJSON, Network: "udp", Address: "localhost:1"},
+		{Name: "a", Type: "gelf", Network: "tcp", Address: "localhost:1"},
+		{Name: "a", Type: SinkSyslog, Network: "tcp", Address: "localhost:1", Facility: "local9"},
+		{Type: SinkSyslog, Network: "tcp", Address: "localhost:1"},
+	}
+	for _, sink := range invalid {
+		if sink.Validate() == nil {
+			t.Errorf("Expected an error for %+v", sink)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Tail
+// -----------------------------------------------------------------------------
+
+func TestOutputRing(t *testing.T) {
+	ring := newOutputRing(3)
+	if lines := ring.last(0); len(lines) != 0 {
+		t.Errorf("Expected no record got %+v", lines)
+	}
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		ring.add(OutputLine{Stream: "stdout", Line: line})
+	}
+	var read []string
+	for _, line := range ring.last(0) {
+		read = append(read, line.Line)
+	}
+	if !reflect.DeepEqual(read, []string{"c", "d", "e"}) {
+		t.Errorf("Expected the last 3 records got %v", read)
+	}
+	if lines := ring.last(2); len(lines) != 2 || lines[0].Line != "d" {
+		t.Errorf("Expected the last 2 records got %+v", lines)
+	}
+}
+
+// The last records of both streams of a local process are kept
+func TestTail(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "tail")
+	defer os.RemoveAll(directory)
+	processus := Process{
+		Name: "tail",
+		Target: "local",
+		Executable: "sh",
+		Arguments: []string{"-c", "seq 1 10; sleep 0.1; echo failed >&2"},
+		Logs: Logs{Stdout: directory + "/out.log", Stderr: directory + "/err.log", Tail: 5},
+	}
+	started, err := processus.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	waitStatus(t, *started)
+
+	lines := started.Tail(0)
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 records got %+v", lines)
+	}
+	var stdout []string
+	for _, line := range lines {
+		if line.Stream == "stdout" {
+			stdout = append(stdout, line.Line)
+		} else if line.Line != "failed" {
+			t.Errorf("Unexpected record %+v", line)
+		}
+	}
+	if len(stdout) != 4 || stdout[len(stdout) - 1] != "10" {
+		t.Errorf("Expected the last lines of stdout got %v", stdout)
+	}
+	if (StartedProcess{}).Tail(10) != nil {
+		t.Errorf("Expected no records without capture")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to AlertRule
+// -----------------------------------------------------------------------------
+
+func TestAlertRuleValidate(t *testing.T) {
+	invalid := []AlertRule{
+		{},
+		{Pattern: "("},
+		{Pattern: "FATAL", Stream: "stdin"},
+		{Pattern: "FATAL", Count: -1},
+		{Pattern: "FATAL", Action: ActionKill},
+		{Pattern: "FATAL", Action: ActionHook},
+	}
+	for _, rule := range invalid {
+		if rule.Validate() == nil {
+			t.Errorf("Expected an error for %+v", rule)
+		}
+	}
+	valid := AlertRule{Pattern: "FATAL", Count: 5, Within: Duration(time.Minute), Action: ActionHook, Hook: "true"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+}
+
+// Matches are counted within the window of the rule
+func TestAlertMatched(t *testing.T) {
+	alert := newAlertStates([]AlertRule{{Pattern: "refused", Count: 3, Within: Duration(time.Minute)}})[0]
+	start := time.Now()
+	for i, offset := range []time.Duration{0, 30 * time.Second, 70 * time.Second} {
+		if _, triggered := alert.matched(start.Add(offset)); triggered {
+			t.Errorf("Unexpected trigger at match %d", i)
+		}
+	}
+	// The first match is out of the window
+	if matches, triggered := alert.matched(start.Add(80 * time.Second)); !triggered || matches != 3 {
+		t.Errorf("Expected 3 matches within a minute to trigger got %d", matches)
+	}
+	if _, triggered := alert.matched(start.Add(81 * time.Second)); len(alert.matches) != 1 || triggered {
+		t.Errorf("Expected the matches to be counted again")
+	}
+}
+
+// Rules are evaluated on the output of a local process
+func TestWatchAlerts(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "alerts")
+	defer os.RemoveAll(directory)
+	processus := Process{
+		Name: "alerting",
+		Target: "local",
+		Executable: "sh",
+		Arguments: []string{"-c", "sleep 0.2; echo FATAL one; echo ok; echo FATAL two >&2; echo FATAL three"},
+		Logs: Logs{Stdout: directory + "/out.log", Stderr: directory + "/err.log"},
+		Alerts: []AlertRule{
+			{Pattern: "FATAL", Stream: "stdout", Count: 2},
+			{Pattern: "^ok$"},
+		},
+	}
+	started, err := processus.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	alerts := make(chan Alert, 10)
+	err = started.WatchAlerts(func(process *StartedProcess, alert Alert) error {
+		alerts <- alert
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	waitStatus(t, *started)
+
+	received := make(map[string]Alert)
+	for i := 0; i < 2; i++ {
+		select {
+		case alert := <-alerts:
+			received[alert.Rule.Pattern] = alert
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 2 alerts got %+v", received)
+		}
+	}
+	if alert := received["FATAL"]; alert.Line != "FATAL three" || alert.Matches != 2 {
+		t.Errorf("Unexpected alert %+v", alert)
+	}
+	if alert := received["^ok$"]; alert.Line != "ok" || alert.Matches != 1 {
+		t.Errorf("Unexpected alert %+v", alert)
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to CrashReports
+// -----------------------------------------------------------------------------
+
+func TestCoreGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		usesPid bool
+		expected string
+	}{
+		{"core", false, "core"},
+		{"core", true, "core.42"},
+		{"/var/cores/core.%e.%p.%t", true, "/var/cores/core.a-very-long-exe.42.*"},
+		{"%%core-%h-%u", false, "%core-host-*"},
+	}
+	for _, test := range cases {
+		glob := coreGlob(test.pattern, 42, "a-very-long-executable", "host", test.usesPid)
+		if glob != test.expected {
+			t.Errorf("Expected %s got %s for %s", test.expected, glob, test.pattern)
+		}
+	}
+}
+
+func TestCrashReportsRedact(t *testing.T) {
+	reports := CrashReports{Redact: []string{"^DSN$"}}
+	redacted := reports.redact([]string{"PATH=/bin", "DB_PASSWORD=x", "api_key=y", "DSN=z", "EMPTY="})
+	expected := []string{"PATH=/bin", "DB_PASSWORD=REDACTED", "api_key=REDACTED", "DSN=REDACTED", "EMPTY="}
+	if !reflect.DeepEqual(redacted, expected) {
+		t.Errorf("Expected %v got %v", expected, redacted)
+	}
+	if (CrashReports{Redact: []string{"("}}).Validate() == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+// Read the report of a bundle
+func readCrashReport(t *testing.T, directory string, id string) CrashReport {
+	var report CrashReport
+	content, err := ioutil.ReadFile(filepath.Join(directory, id, "report.json"))
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	return report
+}
+
+// The bundle of a local process holds its output, exit status and redacted
+// environment
+func TestCollectCrash(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "crash")
+	defer os.RemoveAll(directory)
+	os.Setenv("WATCHDOG_TEST_TOKEN", "hidden")
+	defer os.Unsetenv("WATCHDOG_TEST_TOKEN")
+
+	processus := Process{
+		Name: "crashing",
+		Target: "local",
+		Executable: "sh",
+		Arguments: []string{"-c", "echo out; echo err >&2; sleep 0.3; exit 3"},
+		Logs: Logs{Stdout: directory + "/out.log", Stderr: directory + "/err.log"},
+	}
+	started, err := processus.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	started.SetID("crashing-0")
+	if err := started.RecordEnvironment(); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	started.ExitStatus = waitStatus(t, *started)
+
+	id, err := started.CollectCrash(CrashReports{Dir: directory + "/crashes", Lines: 1})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if !strings.HasPrefix(id, "crashing-0-") {
+		t.Errorf("Unexpected crash ID %s", id)
+	}
+	report := readCrashReport(t, directory + "/crashes", id)
+	if report.ExitStatus == nil || report.ExitStatus.Code != 3 || report.Pid != started.Pid ||
+		!strings.Contains(report.Command, "exit 3") || report.WorkingDirectory == "" || len(report.Errors) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	found := false
+	for _, variable := range report.Environment {
+		found = found || variable == "WATCHDOG_TEST_TOKEN=REDACTED"
+	}
+	if !found {
+		t.Errorf("Expected the token to be redacted got %v", report.Environment)
+	}
+	stdout, _ := ioutil.ReadFile(filepath.Join(directory, "crashes", id, "stdout.log"))
+	stderr, _ := ioutil.ReadFile(filepath.Join(directory, "crashes", id, "stderr.log"))
+	if string(stdout) != "out\n" || string(stderr) != "err\n" {
+		t.Errorf("Unexpected output %q %q", stdout, stderr)
+	}
+
+	// A crash within the same second gets a bundle of its own
+	again, err := started.CollectCrash(CrashReports{Dir: directory + "/crashes", Lines: 1})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if again != id + "-2" || readCrashReport(t, directory + "/crashes", again).ID != again {
+		t.Errorf("Expected crash ID %s-2 got %s", id, again)
+	}
+	if readCrashReport(t, directory + "/crashes", id).ID != id {
+		t.Errorf("Expected the first bundle to be kept")
+	}
+}
+
+// The core dumped by a local process is copied in its bundle
+func TestCollectCrashCore(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "crash")
+	defer os.RemoveAll(directory)
+	processus := Process{
+		Name: "dumping",
+		Target: "local",
+		Executable: "sh",
+		Arguments: []string{"-c", "cd " + directory + " && ulimit -c unlimited && exec sleep 10"},
+		Logs: Logs{Stdout: directory + "/out.log", Stderr: directory + "/err.log"},
+	}
+	started, err := processus.RunLocalProcess()
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	started.SetID("dumping-0")
+	time.Sleep(200 * time.Millisecond)
+	if err := started.RecordEnvironment(); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	if err := started.Signal(syscall.SIGSEGV); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	started.ExitStatus = waitStatus(t, *started)
+
+	id, err := started.CollectCrash(CrashReports{Dir: directory + "/crashes"})
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	report := readCrashReport(t, directory + "/crashes", id)
+	if report.Core == "" {
+		t.Skipf("No core collected: %v", report.Errors)
+	}
+	if info, err := os.Stat(filepath.Join(directory, "crashes", id, report.Core)); err != nil || info.Size() == 0 {
+		t.Errorf("Expected the core file in the bundle")
+	}
+}
+
+// -----------------------------------------------------------------------------
+// Test code related to Notifiers
+// -----------------------------------------------------------------------------
+
+func TestNotifyLimiter(t *testing.T) {
+	limiter := &notifyLimiter{
+		NotifyFilter: NotifyFilter{Events: []string{"crashed", "target-down"}, Processes: []string{"web"},
+			Dedup: Duration(time.Minute), RateLimit: 2},
+		last: make(map[string]time.Time),
+	}
+	now := time.Now()
+	cases := []struct {
+		notification Notification
+		at time.Duration
+		admitted bool
+		suppressed int
+	}{
+		{Notification{Kind: "started", Process: "web", Instance: "web-0"}, 0, false, 0},
+		{Notification{Kind: "crashed", Process: "db", Instance: "db-0"}, 0, false, 0},
+		{Notification{Kind: "crashed", Process: "web", Instance: "web-0"}, 0, true, 0},
+		{Notification{Kind: "crashed", Process: "web", Instance: "web-0"}, time.Second, false, 0},
+		{Notification{Kind: "target-down", Target: "ssh-1"}, time.Second, true, 1},
+		// Rate limited until a minute passed since the first one
+		{Notification{Kind: "crashed", Process: "web", Instance: "web-1"}, 2 * time.Second, false, 0},
+		{Notification{Kind: "crashed", Process: "web", Instance: "web-1"}, 61 * time.Second, true, 1},
+		// Deduplication window expired
+		{Notification{Kind: "crashed", Process: "web", Instance: "web-0"}, 62 * time.Second, true, 0},
+	}
+	for i, test := range cases {
+		admitted := limiter.admit(&test.notification, now.Add(test.at))
+		if admitted != test.admitted || test.notification.Suppressed != test.suppressed {
+			t.Errorf("Case %d: expected %v with %d suppressed got %v with %d", i, test.admitted,
+				test.suppressed, admitted, test.notification.Suppressed)
+		}
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		requests <- request
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	err := OpenNotifiers(Notifiers{Webhooks: []Webhook{{
+		URL: server.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Template: `{"text": {{json (printf "%s on %s: %s" .Kind .Instance .Message)}}}`,
+	}}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	Notify(Notification{Time: time.Now(), Kind: "crashed", Instance: "web-0", Process: "web",
+		Message: `Instance ended with code "1"`})
+	CloseNotifiers(5 * time.Second)
+
+	select {
+	case request := <-requests:
+		if request.Method != http.MethodPost || request.Header.Get("Authorization") != "Bearer secret" ||
+			request.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected request %s %v", request.Method, request.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a request")
+	}
+	expected := `{"text": "crashed on web-0: Instance ended with code \"1\""}`
+	if body := <-bodies; body != expected {
+		t.Errorf("Expected %s got %s", expected, body)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var lock sync.Mutex
+	attempts := make(map[string]int)
+	received := make(chan Notification, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var notification Notification
+		json.NewDecoder(request.Body).Decode(&notification)
+		lock.Lock()
+		attempts[notification.Instance]++
+		count := attempts[notification.Instance]
+		lock.Unlock()
+		switch {
+		case notification.Instance == "rejected":
+			writer.WriteHeader(http.StatusBadRequest)
+		case count < 3:
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			received <- notification
+		}
+	}))
+	defer server.Close()
+
+	core, logs := observer.New(zap.InfoLevel)
+	err := OpenNotifiers(Notifiers{Webhooks: []Webhook{{URL: server.URL, RetryDelay: Duration(10 * time.Millisecond)}}},
+		zap.New(core))
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	Notify(Notification{Kind: "fatal", Instance: "rejected", Message: "Unable to start"})
+	Notify(Notification{Kind: "fatal", Instance: "web-0", Message: "Unable to restart"})
+	CloseNotifiers(5 * time.Second)
+
+	select {
+	case notification := <-received:
+		if notification.Kind != "fatal" || notification.Message != "Unable to restart" {
+			t.Errorf("Unexpected notification %+v", notification)
+		}
+	default:
+		t.Fatalf("Expected the notification after its retries")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts["web-0"] != 3 || attempts["rejected"] != 1 {
+		t.Errorf("Expected 3 attempts and 1 rejected got %v", attempts)
+	}
+	failures := logs.FilterMessage("Unable to send the notification to a webhook").All()
+	if len(failures) != 1 || failures[0].ContextMap()["instance"] != "rejected" ||
+		failures[0].ContextMap()["error"] != "Webhook answered 400" {
+		t.Errorf("Expected the rejected notification to be logged got %+v", failures)
+	}
+}
+
+// The URL of a webhook which can not be reached is not logged
+func TestWebhookFailureRedacted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	core, logs := observer.New(zap.InfoLevel)
+	err = OpenNotifiers(Notifiers{Webhooks: []Webhook{{URL: "http://" + address + "/services/SECRET-TOKEN",
+		Retries: -1}}}, zap.New(core))
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	Notify(Notification{Kind: "fatal", Instance: "web-0", Message: "Unable to restart"})
+	CloseNotifiers(5 * time.Second)
+
+	failures := logs.FilterMessage("Unable to send the notification to a webhook").All()
+	if len(failures) != 1 || failures[0].ContextMap()["host"] != address {
+		t.Fatalf("Expected the failure to be logged got %+v", failures)
+	}
+	if message := failures[0].ContextMap()["error"].(string); strings.Contains(message, "SECRET") {
+		t.Errorf("Expected the URL to be left out of the log got %s", message)
+	}
+}
+
+func TestWebhookValidate(t *testing.T) {
+	for _, webhook := range []Webhook{
+		{URL: "ftp://example.com/hook"},
+		{URL: "/hook"},
+		{URL: "https://example.com/hook", Template: "{{.Kind"},
+		{URL: "https://example.com/hook", NotifyFilter: NotifyFilter{RateLimit: -1}},
+	} {
+		if webhook.Validate() == nil {
+			t.Errorf("Expected an error for %+v", webhook)
+		}
+	}
+	if err := (Webhook{URL: "https://example.com/hook", Template: "{{json .}}"}).Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+}
+
+// Email received by the test SMTP server
+type receivedEmail struct {
+	tls bool
+	auth string
+	to []string
+	message *mail.Message
+}
+
+// Serve SMTP on a local port, offering STARTTLS and PLAIN authentication, and
+// send the emails received on the channel
+func serveSMTP(t *testing.T, emails chan receivedEmail) net.Listener {
+	server := httptest.NewTLSServer(nil)
+	certificate := server.TLS.Certificates[0]
+	server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go smtpSession(connection, certificate, emails)
+		}
+	}()
+	return listener
+}
+
+// Answer the commands of one SMTP client
+func smtpSession(connection net.Conn, certificate tls.Certificate, emails chan receivedEmail) {
+	text := textproto.NewConn(connection)
+	defer func() { text.Close() }()
+	var received receivedEmail
+	text.PrintfLine("220 localhost ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO":
+			if received.tls {
+				text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			} else {
+				text.PrintfLine("250-localhost\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 Ready")
+			secured := tls.Server(connection, &tls.Config{Certificates: []tls.Certificate{certificate}})
+			if secured.Handshake() != nil {
+				return
+			}
+			text = textproto.NewConn(secured)
+			received.tls = true
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			received.auth = string(credentials)
+			text.PrintfLine("235 Authenticated")
+		case "RCPT":
+			received.to = append(received.to, line)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			received.message, _ = mail.ReadMessage(bytes.NewReader(data))
+			emails <- received
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// Decoded subject and body of an email
+func readEmail(t *testing.T, message *mail.Message) (string, string) {
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(message.Body))
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	return subject, string(body)
+}
+
+func TestEmailDigest(t *testing.T) {
+	emails := make(chan receivedEmail, 2)
+	listener := serveSMTP(t, emails)
+	defer listener.Close()
+
+	err := OpenNotifiers(Notifiers{Emails: []Email{{
+		Server: listener.Addr().String(),
+		Username: "watchdog",
+		Password: "secret",
+		RequireTLS: true,
+		InsecureSkipVerify: true,
+		From: "watchdog@example.com",
+		To: []string{"oncall@example.com", "ops@example.com"},
+		Digest: Duration(300 * time.Millisecond),
+	}}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	defer CloseNotifiers(5 * time.Second)
+	Notify(Notification{Time: time.Now(), Kind: "crashed", Instance: "web-0", Process: "web",
+		Message: "Instance ended with code 1", Output: []OutputLine{{Stream: "stderr", Line: "boom"}}})
+	Notify(Notification{Time: time.Now(), Kind: "restarted", Instance: "web-0", Process: "web",
+		Message: "Replaced pid 41 by 42"})
+
+	var received receivedEmail
+	select {
+	case received = <-emails:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an email")
+	}
+	if !received.tls || received.auth != "\x00watchdog\x00secret" || len(received.to) != 2 {
+		t.Errorf("Expected an authenticated email over TLS to 2 recipients got %v %q %v", received.tls,
+			received.auth, received.to)
+	}
+	subject, body := readEmail(t, received.message)
+	if subject != "[watchdog] 2 events" {
+		t.Errorf("Unexpected subject %s", subject)
+	}
+	for _, expected := range []string{"crashed web-0: Instance ended with code 1", "stderr | boom",
+		"restarted web-0: Replaced pid 41 by 42"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in %s", expected, body)
+		}
+	}
+	select {
+	case <-emails:
+		t.Errorf("Expected a single digest")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestEmailClose(t *testing.T) {
+	emails := make(chan receivedEmail, 1)
+	listener := serveSMTP(t, emails)
+	defer listener.Close()
+
+	err := OpenNotifiers(Notifiers{Emails: []Email{{
+		Server: listener.Addr().String(),
+		InsecureSkipVerify: true,
+		From: "watchdog@example.com",
+		To: []string{"oncall@example.com"},
+		Subject: "Événement {{(index .Notifications 0).Kind}}\non {{(index .Notifications 0).Target}}",
+		Body: "{{range .Notifications}}{{.Message}}{{end}}",
+		Digest: Duration(time.Hour),
+	}}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	Notify(Notification{Time: time.Now(), Kind: "target-down", Target: "ssh-1", Message: "3 failed SSH connections"})
+	// The digest is sent when closing rather than at the end of its window
+	CloseNotifiers(5 * time.Second)
+
+	select {
+	case received := <-emails:
+		subject, body := readEmail(t, received.message)
+		if subject != "Événement target-down on ssh-1" || strings.TrimSpace(body) != "3 failed SSH connections" {
+			t.Errorf("Unexpected email %s: %s", subject, body)
+		}
+	default:
+		t.Fatalf("Expected an email")
+	}
+}
+
+// A digest which could not be sent is logged, and so are the notifications
+// discarded beyond maxDigest or at close
+func TestEmailSendFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fatal Error : %+v", err)
+	}
+	server := listener.Addr().String()
+	listener.Close()
+
+	core, logs := observer.New(zap.InfoLevel)
+	email := Email{Server: server, From: "watchdog@example.com", To: []string{"oncall@example.com"}}
+	notifier, err := openEmail(email, zap.New(core))
+	if err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	pending := make([]Notification, maxDigest + 5)
+	if left := notifier.flush(pending); len(left) != maxDigest {
+		t.Errorf("Expected %d notifications kept got %d", maxDigest, len(left))
+	}
+	failures := logs.FilterMessage("Unable to send the notifications by email").All()
+	if len(failures) != 1 || failures[0].ContextMap()["server"] != server ||
+		failures[0].ContextMap()["notifications"] != int64(maxDigest + 5) {
+		t.Errorf("Expected the failure to be logged got %+v", failures)
+	}
+	discarded := logs.FilterMessage("Oldest notifications of the email digest discarded").All()
+	if len(discarded) != 1 || discarded[0].ContextMap()["discarded"] != int64(5) {
+		t.Errorf("Expected 5 notifications discarded got %+v", discarded)
+	}
+
+	core, logs = observer.New(zap.InfoLevel)
+	email.Digest = Duration(time.Hour)
+	if err := OpenNotifiers(Notifiers{Emails: []Email{email}}, zap.New(core)); err != nil {
+		t.Fatalf("Expected nil got %s", err.Error())
+	}
+	Notify(Notification{Time: time.Now(), Kind: "crashed", Instance: "web-0", Message: "Instance ended"})
+	CloseNotifiers(5 * time.Second)
+	closed := logs.FilterMessage("Notifications discarded at close of the email notifier").All()
+	if len(closed) != 1 || closed[0].ContextMap()["discarded"] != int64(1) {
+		t.Errorf("Expected 1 notification discarded at close got %+v", closed)
+	}
+}
+
+func TestEmailValidate(t *testing.T) {
+	valid := Email{Server: "smtp.example.com:587", From: "watchdog@example.com", To: []string{"ops@example.com"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected nil got %s", err.Error())
+	}
+	invalid := []Email{valid, valid, valid, valid}
+	invalid[0].Server = "smtp.example.com"
+	invalid[1].To = nil
+	invalid[2].Subject = "{{.Kind"
+	invalid[3].NotifyFilter.Dedup = Duration(-time.Second)
+	for _, email := range invalid {
+		if email.Validate() == nil {
+			t.Errorf("Expected an error for %+v", email)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package process
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// States of an instance
+const (
+	// Started but its readiness probes did not pass yet
+	StateStarting = "STARTING"
+	// Ready to serve
+	StateReady = "READY"
+	// Not ready in time, or failing its health check
+	StateUnhealthy = "UNHEALTHY"
+)
+
+// Readiness define the probes an instance must pass before it is ready. Every
+// probe defined must pass.
+type Readiness struct {
+	// Regex matched against the lines of stdout and stderr, require the output
+	// to be captured by the watchdog (local or streamed processes)
+	LogRegex string     `json:"log_regex"`
+	// Port accepting connections, on host (127.0.0.1 by default). Remote ports
+	// are probed through an SSH port-forward.
+	Port int            `json:"port"`
+	Host string         `json:"host"`
+	// READY=1 sent on NOTIFY_SOCKET, local processes only
+	Notify bool         `json:"notify"`
+	// Time allowed to become ready before being UNHEALTHY (60s) and time
+	// between two port probes (1s)
+	Timeout Duration    `json:"timeout"`
+	Interval Duration   `json:"interval"`
+}
+
+// Validate return an error if the probes can not be run
+func (readiness Readiness) Validate() error {
+	if _, err := regexp.Compile(readiness.LogRegex); err != nil {
+		return errors.New("Invalid log_regex: " + err.Error())
+	}
+	if readiness.LogRegex == "" && readiness.Port <= 0 && !readiness.Notify {
+		return errors.New("Readiness require a log_regex, a port or notify")
+	}
+	return nil
+}
+
+// State of an instance shared by every copy of its StartedProcess
+type instanceState struct {
+	lock sync.Mutex
+	state string
+	logRegex *regexp.Regexp
+	logMatched bool
+	// Closed when the state first leave STARTING
+	settled chan struct{}
+	// Whether the output goes through observe, and when it was last seen
+	capturing bool
+	lastOutput time.Time
+	// Messages received on the NOTIFY_SOCKET of the instance
+	notifying bool
+	notifyRequired bool
+	notifyReady bool
+	notifyStatus string
+	lastPing time.Time
+	pingTriggered bool
+	// Last samples of the resources used, oldest first
+	usage []Usage
+	// Time of the last sample checked against the resource rules and since
+	// when each rule is exceeded
+	checked time.Time
+	exceeding []time.Time
+	// Probes of the health check
+	health HealthStats
+	// How the process ended once known, and whether it was no longer found
+	// when its usage was sampled
+	exitStatus *ExitStatus
+	gone bool
+	// Closed when the instance is replaced and no longer watched
+	retired chan struct{}
+	retireOnce sync.Once
+	// Tags of the output forwarded and the sinks receiving it
+	process string
+	instance string
+	target string
+	sinks []*logSink
+	// Last records of output
+	tail *outputRing
+	// Alert rules evaluated on the output and the alerts they triggered
+	alerts []*alertState
+	alerted chan Alert
+	// Environment and working directory of the process, read for its crash
+	// report
+	environment []string
+	workingDirectory string
+}
+
+// Create the state of an instance, ready at once when it has no probes
+func newInstanceState(readiness *Readiness) *instanceState {
+	state := &instanceState{
+		state: StateReady,
+		settled: make(chan struct{}),
+		lastOutput: time.Now(),
+		retired: make(chan struct{}),
+	}
+	if readiness == nil {
+		close(state.settled)
+		return state
+	}
+	state.state = StateStarting
+	if readiness.LogRegex != "" {
+		state.logRegex = regexp.MustCompile(readiness.LogRegex)
+	}
+	state.notifyRequired = readiness.Notify
+	return state
+}
+
+// Match a line of output against the readiness regex
+func (state *instanceState) observe(line string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.lastOutput = time.Now()
+	if state.logRegex != nil && !state.logMatched && state.logRegex.MatchString(line) {
+		state.logMatched = true
+	}
+}
+
+// Change the state of the instance
+func (state *instanceState) set(value string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.state == StateStarting && value != StateStarting {
+		close(state.settled)
+	}
+	state.state = value
+}
+
+// State return the state of the instance (STARTING, READY or UNHEALTHY)
+func (process StartedProcess) State() string {
+	if process.state == nil {
+		return ""
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	return process.state.state
+}
+
+// WaitReady block until the instance is READY. An error is returned if it
+// became UNHEALTHY first or ended.
+func (process StartedProcess) WaitReady() error {
+	if process.state == nil {
+		return nil
+	}
+	var ended chan struct{}
+	if process.exit != nil {
+		ended = process.exit.done
+	}
+	select {
+	case <-process.state.settled:
+		if state := process.State(); state != StateReady {
+			return errors.New(process.ID + " is " + state)
+		}
+		return nil
+	case <-ended:
+		return ErrProcessEnded
+	}
+}
+
+// Run the readiness probes of the instance until they all pass
+func (process StartedProcess) trackReadiness(readiness *Readiness) {
+	if readiness == nil {
+		return
+	}
+	var port *HealthCheck
+	if readiness.Port > 0 {
+		port = &HealthCheck{
+			Type: "tcp",
+			Host: readiness.Host,
+			Port: readiness.Port,
+			From: FromTunnel,
+			Timeout: readiness.Interval,
+		}
+		if port.Host == "" {
+			port.Host = "127.0.0.1"
+		}
+	}
+
+	go func() {
+		deadline := time.After(readiness.Timeout.or(time.Minute))
+		ticker := time.NewTicker(readiness.Interval.or(time.Second))
+		defer ticker.Stop()
+		for {
+			if process.unwatched() {
+				return
+			}
+			if port != nil && port.Probe(process) == nil {
+				port = nil
+			}
+			process.state.lock.Lock()
+			ready := port == nil && (process.state.logRegex == nil || process.state.logMatched) &&
+				(!process.state.notifyRequired || process.state.notifyReady)
+			process.state.lock.Unlock()
+			if ready {
+				process.state.set(StateReady)
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-deadline:
+				process.state.set(StateUnhealthy)
+			}
+		}
+	}()
+}
+
+// Retire stop every watcher of the instance, called before it is replaced
+func (process StartedProcess) Retire() {
+	if process.state != nil {
+		process.state.retireOnce.Do(func() {
+			close(process.state.retired)
+		})
+	}
+}
+
+// Whether the instance was retired
+func (process StartedProcess) retired() bool {
+	if process.state == nil {
+		return false
+	}
+	select {
+	case <-process.state.retired:
+		return true
+	default:
+		return false
+	}
+}
+
+// Whether the watchers of the instance should stop: it was retired or the
+// process the watchdog is attached to ended
+func (process StartedProcess) unwatched() bool {
+	if process.retired() {
+		return true
+	}
+	if process.exit != nil {
+		select {
+		case <-process.exit.done:
+			return true
+		default:
+		}
+	}
+	return false
+}
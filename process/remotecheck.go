@@ -0,0 +1,182 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Where a health check runs from (HealthCheck.From)
+const (
+	// The watchdog host probes the service directly (default)
+	FromWatchdog = "watchdog"
+	// The probe runs on the target over SSH (curl, nc, the command or stat)
+	FromTarget = "target"
+	// The watchdog host probes the service through an SSH port-forward
+	FromTunnel = "tunnel"
+)
+
+// Run a single attempt of the check on the target of the process over SSH
+func (check HealthCheck) attemptOnTarget(ctx context.Context, process StartedProcess) error {
+	timeout := check.Timeout.or(5 * time.Second)
+	output, code, err := runRemote(ctx, process, check.targetCommand(timeout))
+	if err != nil {
+		return err
+	}
+
+	switch check.Type {
+	case "http":
+		// curl print the body followed by the status on its own line
+		end := strings.LastIndex(output, "\n")
+		status, err := strconv.Atoi(strings.TrimSpace(output[end+1:]))
+		if err != nil {
+			return fmt.Errorf("curl failed with exit code %d", code)
+		}
+		return check.verifyHTTP(status, []byte(output[:end+1]))
+	case "tcp":
+		if code != 0 {
+			return fmt.Errorf("Unable to connect to port %d on %s", check.Port, process.Server.Name)
+		}
+		return nil
+	case "exec":
+		return check.verifyExitCode(code)
+	case "file":
+		// stat and date print the modification time and the current time
+		times := strings.Fields(output)
+		if code != 0 || len(times) != 2 {
+			return errors.New("Unable to stat " + check.Path + " on " + process.Server.Name)
+		}
+		modified, err := strconv.ParseInt(times[0], 10, 64)
+		if err != nil {
+			return errors.New("Unexpected output " + output)
+		}
+		now, err := strconv.ParseInt(times[1], 10, 64)
+		if err != nil {
+			return errors.New("Unexpected output " + output)
+		}
+		return check.verifyAge(time.Duration(now - modified) * time.Second)
+	}
+	return errors.New("Unknown health check type " + check.Type)
+}
+
+// Create the command probing the service from the target
+func (check HealthCheck) targetCommand(timeout time.Duration) string {
+	seconds := strconv.Itoa(int((timeout + time.Second - 1) / time.Second))
+	switch check.Type {
+	case "http":
+		return "curl -sS -m " + seconds + " -w '\\n%{http_code}' " + shellQuote(check.URL)
+	case "tcp":
+		host := check.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		port := strconv.Itoa(check.Port)
+		return "if command -v nc > /dev/null; then nc -z -w " + seconds + " " + shellQuote(host) + " " + port +
+			"; else timeout " + seconds + " bash -c " + shellQuote("exec 3<> /dev/tcp/" + host + "/" + port) + "; fi"
+	case "exec":
+		var quoted []string
+		for _, argument := range check.Command {
+			quoted = append(quoted, shellQuote(argument))
+		}
+		return "timeout " + seconds + " " + strings.Join(quoted, " ")
+	case "file":
+		return "stat -c %Y " + shellQuote(check.Path) + " && date +%s"
+	}
+	return "false"
+}
+
+// Run a single attempt of an http or tcp check from the watchdog host through
+// an SSH port-forward, the service only has to listen on the target
+func (check HealthCheck) attemptThroughTunnel(ctx context.Context, process StartedProcess) error {
+	connection, err := dialTarget(process.Server)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	go func() {
+		// Unblock the dial or the request when the attempt times out
+		<-ctx.Done()
+		connection.Close()
+	}()
+
+	switch check.Type {
+	case "http":
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return connection.Dial(network, address)
+				},
+				DisableKeepAlives: true,
+			},
+		}
+		request, err := http.NewRequest("GET", check.URL, nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1 << 20))
+		if err != nil {
+			return err
+		}
+		return check.verifyHTTP(response.StatusCode, body)
+	case "tcp":
+		host := check.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		tunnel, err := connection.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(check.Port)))
+		if err != nil {
+			return err
+		}
+		return tunnel.Close()
+	}
+	return errors.New(check.Type + " health check can not run through a tunnel")
+}
+
+// Run a command on the target of the process with its privileges and return
+// its output and exit code. The connection is closed when ctx is done.
+func runRemote(ctx context.Context, process StartedProcess, command string) (string, int, error) {
+	connection, err := dialTarget(process.Server)
+	if err != nil {
+		return "", 0, err
+	}
+	defer connection.Close()
+	session, err := connection.NewSession()
+	if err != nil {
+		return "", 0, errors.New("Impossible to establish the connection")
+	}
+	var buffer bytes.Buffer
+	session.Stdout = &buffer
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(wrapPrivilege(command, process.RunAs, process.Sudo))
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		connection.Close()
+		return "", 0, ctx.Err()
+	}
+
+	if exitError, ok := err.(*ssh.ExitError); ok {
+		return buffer.String(), exitError.ExitStatus(), nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	return buffer.String(), 0, nil
+}
@@ -0,0 +1,122 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote output files rotated by an instance, by target and path, guarded by
+// remoteLogsLock. Instances sharing their files let a single one rotate them.
+var remoteLogs = make(map[string]bool)
+var remoteLogsLock sync.Mutex
+
+// WatchRemoteLogs rotate the output files a remote process write on its target
+// as defined by the rotation of its Logs. Their size is checked every minute,
+// or at rotation.every when shorter. The files are copied then truncated so
+// the process keeps writing to the same file. The watch stops once the
+// instance is retired.
+func (process StartedProcess) WatchRemoteLogs() error {
+	rotation := process.Logs.Rotation
+	if rotation == nil {
+		return errors.New("No rotation defined for the logs of " + process.ID)
+	}
+	if process.Server.Name == "local" || process.Logs.Mode == StreamLogs {
+		return errors.New("Logs of " + process.ID + " are not written on its target")
+	}
+
+	key := process.Server.Name + "\x00" + process.Logs.Stdout + "\x00" + process.Logs.Stderr
+	remoteLogsLock.Lock()
+	defer remoteLogsLock.Unlock()
+	if remoteLogs[key] {
+		return nil
+	}
+	remoteLogs[key] = true
+
+	interval := time.Minute
+	if rotation.Every > 0 && time.Duration(rotation.Every) < interval {
+		interval = time.Duration(rotation.Every)
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		defer func() {
+			remoteLogsLock.Lock()
+			delete(remoteLogs, key)
+			remoteLogsLock.Unlock()
+		}()
+		rotated := time.Now()
+		for range ticker.C {
+			if process.retired() {
+				return
+			}
+			force := rotation.Every > 0 && time.Since(rotated) >= time.Duration(rotation.Every)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			_, code, err := runRemote(ctx, process, rotateCommand(process.Logs, force))
+			cancel()
+			if force && err == nil && code == 0 {
+				rotated = time.Now()
+			}
+		}
+	}()
+	return nil
+}
+
+// Create the command rotating the output files of a remote process, at once
+// when force is set otherwise when they are larger than the maximum size
+func rotateCommand(logs Logs, force bool) string {
+	paths := []string{logs.Stdout}
+	if logs.Stderr != logs.Stdout {
+		paths = append(paths, logs.Stderr)
+	}
+	var commands []string
+	for _, path := range paths {
+		commands = append(commands, rotateFileCommand(path, *logs.Rotation, force))
+	}
+	return strings.Join(commands, "; ")
+}
+
+// Glob of the time in the names of the rotated files, so that the files of
+// other services sharing the prefix are left alone
+const backupTimeGlob = "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]-[0-9][0-9]-[0-9][0-9].[0-9][0-9][0-9]"
+
+// Create the command rotating a file. Rotated files are named like the local
+// ones: <name>-<UTC time><extension>[.gz].
+func rotateFileCommand(path string, rotation Rotation, force bool) string {
+	extension := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, extension)
+	file := shellQuote(path)
+	size := int64(rotation.MaxSize)
+	if size <= 0 {
+		size = defaultRotationSize
+	}
+
+	condition := "[ -s " + file + " ]"
+	if !force {
+		condition += " && [ $(stat -c %s " + file + ") -ge " + strconv.FormatInt(size, 10) + " ]"
+	}
+	command := "if " + condition + "; then backup=" + shellQuote(prefix) +
+		"-$(date -u +%Y-%m-%dT%H-%M-%S.000)" + shellQuote(extension) +
+		"; cp -p " + file + " \"$backup\" && : > " + file
+	if rotation.Compress {
+		command += " && gzip -f \"$backup\""
+	}
+	command += "; fi"
+
+	backups := shellQuote(prefix) + "-" + backupTimeGlob + shellQuote(extension) + "*"
+	if rotation.MaxBackups > 0 {
+		command += "; ls -1t " + backups + " 2> /dev/null | tail -n +" + strconv.Itoa(rotation.MaxBackups + 1) +
+			" | while read -r old; do rm -f \"$old\"; done"
+	}
+	if rotation.MaxAge > 0 {
+		minutes := int64((time.Duration(rotation.MaxAge) + time.Minute - 1) / time.Minute)
+		command += "; find " + shellQuote(filepath.Dir(path)) + " -maxdepth 1 -name " +
+			shellQuote(filepath.Base(prefix) + "-" + backupTimeGlob + extension + "*") +
+			" -mmin +" + strconv.FormatInt(minutes, 10) + " -exec rm -f {} +"
+	}
+	return command
+}
@@ -0,0 +1,192 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of a ResourceRule
+const (
+	// Write the overuse to the watchdog log
+	ActionLog = "log"
+	// Log and send the overuse to the notifiers
+	ActionNotify = "notify"
+	// Stop the instance with SIGTERM, SIGKILL when it did not end in time, and
+	// start a new one
+	ActionRestart = "restart"
+	// Stop the instance with SIGTERM, SIGKILL when it did not end in time, and
+	// remove it from the instances once it ended
+	ActionKill = "kill"
+)
+
+// ResourceRule define a limit on the resources used by an instance, the
+// action is triggered when the limit is exceeded by every sample for the
+// duration of the rule
+type ResourceRule struct {
+	// Resident memory ("2GiB", "512MB" or a number of bytes)
+	MaxRSS ByteSize    `json:"max_rss"`
+	// Percent of one CPU ("95%" or a number)
+	MaxCPU Percent     `json:"max_cpu"`
+	For Duration       `json:"for"`
+	// log (default), notify, restart or kill
+	Action string      `json:"action"`
+}
+
+// Validate return an error if the rule can not be evaluated
+func (rule ResourceRule) Validate() error {
+	if rule.MaxRSS <= 0 && rule.MaxCPU <= 0 {
+		return errors.New("Resource rule require a max_rss or a max_cpu")
+	}
+	switch rule.Action {
+	case "", ActionLog, ActionNotify, ActionRestart, ActionKill:
+	default:
+		return errors.New("Unknown resource rule action " + rule.Action)
+	}
+	return nil
+}
+
+// String describe the limit of the rule
+func (rule ResourceRule) String() string {
+	var limits []string
+	if rule.MaxRSS > 0 {
+		limits = append(limits, "rss > " + rule.MaxRSS.String())
+	}
+	if rule.MaxCPU > 0 {
+		limits = append(limits, fmt.Sprintf("cpu > %g%%", float64(rule.MaxCPU)))
+	}
+	return strings.Join(limits, " or ") + " for " + time.Duration(rule.For).String()
+}
+
+// Whether a sample exceed the limit of the rule
+func (rule ResourceRule) exceeded(usage Usage) bool {
+	return (rule.MaxRSS > 0 && usage.RSS > uint64(rule.MaxRSS)) ||
+		(rule.MaxCPU > 0 && usage.CPU > float64(rule.MaxCPU))
+}
+
+// CheckResources evaluate the rules against the samples taken since the last
+// call and return the rules exceeded for their whole duration. A rule which
+// triggered is evaluated again from the next sample.
+func (process StartedProcess) CheckResources(rules []ResourceRule) []ResourceRule {
+	if process.state == nil || len(rules) == 0 {
+		return nil
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	if process.state.exceeding == nil {
+		process.state.exceeding = make([]time.Time, len(rules))
+	}
+
+	var triggered []ResourceRule
+	for _, usage := range process.state.usage {
+		if !usage.Time.After(process.state.checked) {
+			continue
+		}
+		process.state.checked = usage.Time
+		for i, rule := range rules {
+			if !rule.exceeded(usage) {
+				process.state.exceeding[i] = time.Time{}
+				continue
+			}
+			if process.state.exceeding[i].IsZero() {
+				process.state.exceeding[i] = usage.Time
+			}
+			if usage.Time.Sub(process.state.exceeding[i]) >= time.Duration(rule.For) {
+				process.state.exceeding[i] = time.Time{}
+				triggered = append(triggered, rule)
+			}
+		}
+	}
+	return triggered
+}
+
+// ByteSize is a number of bytes read from the configuration either as a
+// number or as a string with a unit. KB, MB, GB and TB are powers of 1000,
+// K, M, G, T and the KiB forms are powers of 1024.
+type ByteSize uint64
+
+// Multiplier of each unit of a ByteSize
+var byteUnits = map[string]uint64{
+	"": 1, "B": 1,
+	"K": 1 << 10, "KIB": 1 << 10, "KB": 1e3,
+	"M": 1 << 20, "MIB": 1 << 20, "MB": 1e6,
+	"G": 1 << 30, "GIB": 1 << 30, "GB": 1e9,
+	"T": 1 << 40, "TIB": 1 << 40, "TB": 1e12,
+}
+
+// UnmarshalJSON accept both notations of a ByteSize
+func (size *ByteSize) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*size = ByteSize(value)
+	case string:
+		parsed, err := parseByteSize(value)
+		if err != nil {
+			return err
+		}
+		*size = parsed
+	default:
+		return errors.New("Invalid size " + string(data))
+	}
+	return nil
+}
+
+// String write the size with the largest binary unit dividing it
+func (size ByteSize) String() string {
+	for _, unit := range []string{"TiB", "GiB", "MiB", "KiB"} {
+		multiplier := byteUnits[strings.ToUpper(unit)]
+		if size >= ByteSize(multiplier) && uint64(size) % multiplier == 0 {
+			return strconv.FormatUint(uint64(size) / multiplier, 10) + unit
+		}
+	}
+	return strconv.FormatUint(uint64(size), 10) + "B"
+}
+
+// Parse a size such as "2GiB" or "1.5 GB"
+func parseByteSize(text string) (ByteSize, error) {
+	text = strings.TrimSpace(text)
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end < 0 {
+		end = len(text)
+	}
+	number, err := strconv.ParseFloat(text[:end], 64)
+	multiplier, ok := byteUnits[strings.ToUpper(strings.TrimSpace(text[end:]))]
+	if err != nil || !ok {
+		return 0, errors.New("Invalid size " + text)
+	}
+	return ByteSize(number * float64(multiplier)), nil
+}
+
+// Percent is read from the configuration either as a number or as a string
+// ending with %
+type Percent float64
+
+// UnmarshalJSON accept both notations of a Percent
+func (percent *Percent) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*percent = Percent(value)
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil {
+			return errors.New("Invalid percent " + value)
+		}
+		*percent = Percent(parsed)
+	default:
+		return errors.New("Invalid percent " + string(data))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package process
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Signal a local process through a pidfd. The pidfd refers to the process
+// which had the PID when it was opened, checking its identity afterward
+// guarantees the signal reach it even if the PID is reused meanwhile.
+func signalLocal(process StartedProcess, signal syscall.Signal) error {
+	pidfd, err := unix.PidfdOpen(process.Pid, 0)
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		// Kernel older than 5.3
+		return killLocal(process, signal)
+	} else if err == unix.ESRCH {
+		return ErrProcessEnded
+	} else if err != nil {
+		return err
+	}
+	defer unix.Close(pidfd)
+
+	if err := checkIdentity(process); err != nil {
+		return err
+	}
+	err = unix.PidfdSendSignal(pidfd, signal, nil, 0)
+	if err == unix.ESRCH {
+		return ErrProcessEnded
+	}
+	return err
+}
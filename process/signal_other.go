@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package process
+
+import (
+	"syscall"
+)
+
+// Signal a local process, pidfds are only available on Linux
+func signalLocal(process StartedProcess, signal syscall.Signal) error {
+	return killLocal(process, signal)
+}
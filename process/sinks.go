@@ -0,0 +1,522 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Types of Sink
+const (
+	// RFC 5424 syslog over udp, tcp or a unix socket
+	SinkSyslog = "syslog"
+	// One JSON record per line over tcp
+	SinkJSON = "json"
+)
+
+// Sink forward the captured output of processes and the watchdog log to a log
+// server. Records are kept in a buffer file while the server is down or the
+// sink can not keep up, and sent once it is back.
+type Sink struct {
+	Name string          `json:"name"`
+	// syslog or json
+	Type string          `json:"type"`
+	// udp, tcp or unix for syslog, tcp for json
+	Network string       `json:"network"`
+	// host:port or the path of the unix socket
+	Address string       `json:"address"`
+	// Syslog facility, user by default
+	Facility string      `json:"facility"`
+	// File of the records not sent (watchdog-<name>.buffer by default) and its
+	// largest size (10MiB by default), newer records are dropped beyond it
+	Buffer string        `json:"buffer"`
+	MaxBuffer ByteSize   `json:"max_buffer"`
+}
+
+// Default size of the buffer files
+const defaultMaxBuffer = 10 << 20
+
+// Records waiting to be sent or buffered per sink
+const sinkQueue = 1024
+
+// Time between two connections to a server which is down
+var sinkRetryInterval = 5 * time.Second
+
+// Syslog facilities by name
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog severities of the records
+const (
+	severityCritical = 2
+	severityError = 3
+	severityWarning = 4
+	severityInfo = 6
+	severityDebug = 7
+)
+
+// Validate return an error if the sink can not be opened
+func (sink Sink) Validate() error {
+	if sink.Name == "" || sink.Address == "" {
+		return errors.New("Sink require a name and an address")
+	}
+	switch {
+	case sink.Type == SinkSyslog && (sink.Network == "udp" || sink.Network == "tcp" || sink.Network == "unix"):
+	case sink.Type == SinkJSON && sink.Network == "tcp":
+	default:
+		return errors.New("Unsupported " + sink.Type + " sink over " + sink.Network)
+	}
+	if _, ok := syslogFacilities[sink.Facility]; sink.Facility != "" && !ok {
+		return errors.New("Unknown syslog facility " + sink.Facility)
+	}
+	return nil
+}
+
+// Record forwarded to the sinks
+type sinkRecord struct {
+	Time time.Time       `json:"time"`
+	Process string       `json:"process"`
+	Instance string      `json:"instance,omitempty"`
+	Target string        `json:"target,omitempty"`
+	// stdout or stderr of a process, log for the watchdog log
+	Stream string        `json:"stream"`
+	Severity int         `json:"severity"`
+	Message string       `json:"message"`
+}
+
+// Open sink with its connection, queue and buffer file
+type logSink struct {
+	Sink
+	hostname string
+	records chan sinkRecord
+	closing chan struct{}
+	stopped chan struct{}
+
+	// Used by the goroutine sending the records only
+	connection net.Conn
+	datagram bool
+	attempted time.Time
+
+	// Size of the buffer file, guarded by bufferLock along with the file
+	bufferLock sync.Mutex
+	buffered int64
+}
+
+// Open sinks by name, guarded by sinksLock
+var sinks = make(map[string]*logSink)
+var sinksLock sync.Mutex
+
+// OpenSinks start forwarding to the sinks, the records buffered by a previous
+// run are sent first
+func OpenSinks(configs []Sink) error {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	hostname, _ := os.Hostname()
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		if _, ok := sinks[config.Name]; ok {
+			return errors.New("Duplicate sink " + config.Name)
+		}
+		if config.Buffer == "" {
+			config.Buffer = "watchdog-" + config.Name + ".buffer"
+		}
+		if config.MaxBuffer == 0 {
+			config.MaxBuffer = defaultMaxBuffer
+		}
+		sink := &logSink{
+			Sink: config,
+			hostname: hostname,
+			records: make(chan sinkRecord, sinkQueue),
+			closing: make(chan struct{}),
+			stopped: make(chan struct{}),
+		}
+		if info, err := os.Stat(config.Buffer); err == nil {
+			sink.buffered = info.Size()
+		}
+		sinks[config.Name] = sink
+		go sink.run()
+	}
+	return nil
+}
+
+// CloseSinks send the records queued, buffer those which can not be sent
+// within the timeout and close the connections
+func CloseSinks(timeout time.Duration) {
+	sinksLock.Lock()
+	closing := sinks
+	sinks = make(map[string]*logSink)
+	sinksLock.Unlock()
+
+	deadline := time.After(timeout)
+	for _, sink := range closing {
+		close(sink.closing)
+	}
+	for _, sink := range closing {
+		select {
+		case <-sink.stopped:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// SinkExists return whether a sink of this name is open
+func SinkExists(name string) bool {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	_, ok := sinks[name]
+	return ok
+}
+
+// Open sinks among names
+func lookupSinks(names []string) []*logSink {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	var found []*logSink
+	for _, name := range names {
+		if sink, ok := sinks[name]; ok {
+			found = append(found, sink)
+		}
+	}
+	return found
+}
+
+// Queue a record, it is written to the buffer file when the queue is full
+// rather than blocking the output of the process
+func (sink *logSink) send(record sinkRecord) {
+	select {
+	case <-sink.closing:
+	case sink.records <- record:
+	default:
+		sink.store(record)
+	}
+}
+
+// Send the records queued until the sink is closed, and the buffered ones
+// once the server is back
+func (sink *logSink) run() {
+	defer close(sink.stopped)
+	ticker := time.NewTicker(sinkRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-sink.records:
+			sink.deliver(record)
+		case <-sink.closing:
+			sink.drain()
+			return
+		case <-ticker.C:
+			if sink.pending() && sink.connect() {
+				sink.replay()
+			}
+		}
+	}
+}
+
+// Send the records left in the queue and close the connection
+func (sink *logSink) drain() {
+	for {
+		select {
+		case record := <-sink.records:
+			sink.deliver(record)
+		default:
+			if sink.connection != nil {
+				sink.connection.Close()
+			}
+			return
+		}
+	}
+}
+
+// Send a record after the buffered ones, or buffer it
+func (sink *logSink) deliver(record sinkRecord) {
+	if !sink.connect() || (sink.pending() && !sink.replay()) {
+		sink.store(record)
+		return
+	}
+	if err := sink.write(record); err != nil {
+		sink.disconnect()
+		sink.store(record)
+	}
+}
+
+// Connect to the server unless already connected or the last attempt is too
+// recent
+func (sink *logSink) connect() bool {
+	if sink.connection != nil {
+		return true
+	}
+	if time.Since(sink.attempted) < sinkRetryInterval {
+		return false
+	}
+	sink.attempted = time.Now()
+
+	var err error
+	sink.datagram = sink.Network == "udp"
+	if sink.Network == "unix" {
+		// Local syslog daemons listen on a datagram socket
+		sink.connection, err = net.DialTimeout("unixgram", sink.Address, 5 * time.Second)
+		sink.datagram = err == nil
+	}
+	if sink.connection == nil {
+		sink.connection, err = net.DialTimeout(sink.Network, sink.Address, 5 * time.Second)
+	}
+	if err != nil {
+		sink.connection = nil
+		return false
+	}
+	return true
+}
+
+// Close a connection which failed
+func (sink *logSink) disconnect() {
+	sink.connection.Close()
+	sink.connection = nil
+	sink.attempted = time.Now()
+}
+
+// Write a record on the connection
+func (sink *logSink) write(record sinkRecord) error {
+	sink.connection.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := sink.connection.Write([]byte(sink.frame(record)))
+	return err
+}
+
+// Format a record for the server
+func (sink *logSink) frame(record sinkRecord) string {
+	if sink.Type == SinkJSON {
+		encoded, _ := json.Marshal(record)
+		return string(encoded) + "\n"
+	}
+	message := sink.syslogMessage(record)
+	switch {
+	case sink.datagram:
+		return message
+	case sink.Network == "tcp":
+		// Octet counting of RFC 6587
+		return strconv.Itoa(len(message)) + " " + message
+	default:
+		return message + "\n"
+	}
+}
+
+// Format a record as an RFC 5424 message
+func (sink *logSink) syslogMessage(record sinkRecord) string {
+	facility, ok := syslogFacilities[sink.Facility]
+	if !ok {
+		facility = syslogFacilities["user"]
+	}
+	data := "[watchdog@32473 process=\"" + sdEscaper.Replace(record.Process) + "\""
+	if record.Instance != "" {
+		data += " instance=\"" + sdEscaper.Replace(record.Instance) + "\""
+	}
+	if record.Target != "" {
+		data += " target=\"" + sdEscaper.Replace(record.Target) + "\""
+	}
+	data += "]"
+	return "<" + strconv.Itoa(facility * 8 + record.Severity) + ">1 " +
+		record.Time.UTC().Format("2006-01-02T15:04:05.000000Z") + " " +
+		syslogField(sink.hostname, 255) + " " + syslogField(record.Process, 48) + " " +
+		syslogField(record.Instance, 128) + " " + syslogField(record.Stream, 32) + " " +
+		data + " " + record.Message
+}
+
+// Escape the values of structured data
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Header field of a syslog message, printable ASCII without spaces
+func syslogField(value string, length int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "-"
+	}
+	if len(value) > length {
+		value = value[:length]
+	}
+	return value
+}
+
+// Whether records wait in the buffer file
+func (sink *logSink) pending() bool {
+	sink.bufferLock.Lock()
+	defer sink.bufferLock.Unlock()
+	return sink.buffered > 0
+}
+
+// Append a record to the buffer file, it is dropped once the file is full
+func (sink *logSink) store(record sinkRecord) {
+	encoded, _ := json.Marshal(record)
+	encoded = append(encoded, '\n')
+	sink.bufferLock.Lock()
+	defer sink.bufferLock.Unlock()
+	if sink.buffered + int64(len(encoded)) > int64(sink.MaxBuffer) {
+		return
+	}
+	file, err := os.OpenFile(sink.Buffer, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(encoded); err == nil {
+		sink.buffered += int64(len(encoded))
+	}
+}
+
+// Send the buffered records, those which could not be sent stay in the file.
+// The file is not locked while sending, records stored meanwhile are kept.
+func (sink *logSink) replay() bool {
+	sink.bufferLock.Lock()
+	content, err := ioutil.ReadFile(sink.Buffer)
+	if err != nil {
+		sink.buffered = 0
+		sink.bufferLock.Unlock()
+		return true
+	}
+	sink.bufferLock.Unlock()
+	reader := bufio.NewReader(bytes.NewReader(content))
+	sent := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		var record sinkRecord
+		if json.Unmarshal([]byte(line), &record) == nil {
+			if sink.write(record) != nil {
+				sink.disconnect()
+				break
+			}
+		}
+		sent += len(line)
+	}
+
+	sink.bufferLock.Lock()
+	defer sink.bufferLock.Unlock()
+	content, err = ioutil.ReadFile(sink.Buffer)
+	if err != nil || len(content) < sent {
+		return false
+	}
+	left := content[sent:]
+	if err := ioutil.WriteFile(sink.Buffer, left, 0600); err != nil {
+		return false
+	}
+	sink.buffered = int64(len(left))
+	return len(left) == 0
+}
+
+// Forward a line of output of an instance to its sinks
+func (state *instanceState) forward(stream string, line string) {
+	state.lock.Lock()
+	record := sinkRecord{
+		Time: time.Now(),
+		Process: state.process,
+		Instance: state.instance,
+		Target: state.target,
+		Stream: stream,
+		Severity: severityInfo,
+		Message: line,
+	}
+	destinations := state.sinks
+	state.lock.Unlock()
+	if stream == "stderr" {
+		record.Severity = severityError
+	}
+	for _, sink := range destinations {
+		sink.send(record)
+	}
+}
+
+// Core of a zap logger forwarding the watchdog log to sinks
+type sinkCore struct {
+	zapcore.LevelEnabler
+	sinks []*logSink
+	fields []zapcore.Field
+}
+
+// SinkCore create the zap core forwarding the records of the watchdog log
+// enabled at level to the sinks named
+func SinkCore(names []string, level zapcore.LevelEnabler) (zapcore.Core, error) {
+	found := lookupSinks(names)
+	if len(found) != len(names) {
+		return nil, errors.New("Unknown sink in " + strings.Join(names, ", "))
+	}
+	return &sinkCore{LevelEnabler: level, sinks: found}, nil
+}
+
+// With add fields to the records of the core
+func (core *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	return &sinkCore{
+		LevelEnabler: core.LevelEnabler,
+		sinks: core.sinks,
+		fields: append(append([]zapcore.Field{}, core.fields...), fields...),
+	}
+}
+
+// Check add the core to the entries enabled
+func (core *sinkCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if core.Enabled(entry.Level) {
+		return checked.AddCore(entry, core)
+	}
+	return checked
+}
+
+// Write forward the entry, its fields follow the message as a JSON object
+func (core *sinkCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range append(append([]zapcore.Field{}, core.fields...), fields...) {
+		field.AddTo(encoder)
+	}
+	message := entry.Message
+	if len(encoder.Fields) > 0 {
+		encoded, _ := json.Marshal(encoder.Fields)
+		message += " " + string(encoded)
+	}
+
+	record := sinkRecord{
+		Time: entry.Time,
+		Process: "watchdog",
+		Stream: "log",
+		Severity: severityInfo,
+		Message: message,
+	}
+	switch {
+	case entry.Level >= zapcore.DPanicLevel:
+		record.Severity = severityCritical
+	case entry.Level == zapcore.ErrorLevel:
+		record.Severity = severityError
+	case entry.Level == zapcore.WarnLevel:
+		record.Severity = severityWarning
+	case entry.Level == zapcore.DebugLevel:
+		record.Severity = severityDebug
+	}
+	for _, sink := range core.sinks {
+		sink.send(record)
+	}
+	return nil
+}
+
+// Sync does nothing, the records are sent asynchronously
+func (core *sinkCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,237 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// OpenSSH client configuration files looked up by ssh_config_host, the first
+// file defining a key wins (same precedence as ssh(1))
+var sshConfigFiles = []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+
+// Resolve return the Target with the fields left empty in the watchdog
+// configuration filled from the OpenSSH client configuration of its
+// ssh_config_host. Explicit fields always override the ssh configuration.
+func (server Target) Resolve() (Target, error) {
+	if server.SSHConfigHost == "" {
+		return server, nil
+	}
+	configs, err := loadSSHConfigs()
+	if err != nil {
+		return server, err
+	}
+	alias := server.SSHConfigHost
+	lookup := func(key string) (string, error) {
+		for _, config := range configs {
+			value, err := config.Get(alias, key)
+			if err != nil || value != "" {
+				return value, err
+			}
+		}
+		return "", nil
+	}
+
+	var values = make(map[string]string)
+	for _, key := range []string{"HostName", "Port", "User", "IdentityFile", "ProxyJump"} {
+		value, err := lookup(key)
+		if err != nil {
+			return server, err
+		}
+		values[key] = value
+	}
+
+	if server.Hostname == "" {
+		server.Hostname = alias
+		if values["HostName"] != "" {
+			server.Hostname = strings.Replace(values["HostName"], "%h", alias, -1)
+		}
+	}
+	if server.Port == 0 {
+		server.Port = 22
+		if values["Port"] != "" {
+			server.Port, err = strconv.Atoi(values["Port"])
+			if err != nil {
+				return server, errors.New("Invalid Port in ssh configuration for " + alias)
+			}
+		}
+	}
+	if server.Username == "" {
+		server.Username = values["User"]
+		if server.Username == "" {
+			server.Username = os.Getenv("USER")
+		}
+	}
+	if server.Auth.Password == "" && server.Auth.PrivateKey == "" && values["IdentityFile"] != "" {
+		server.Auth.PrivateKey = expandSSHPath(values["IdentityFile"], server)
+	}
+	if server.ProxyJump == "" && values["ProxyJump"] != "none" {
+		server.ProxyJump = values["ProxyJump"]
+	}
+	return server, nil
+}
+
+// Return the hosts to hop through, in order, before reaching the server.
+// A jump host is itself resolved through the ssh configuration and reuse the
+// credentials of the server when it does not define its own.
+func (server Target) jumpHosts() ([]Target, error) {
+	var hops []Target
+	if server.ProxyJump == "" {
+		return hops, nil
+	}
+	for _, jump := range strings.Split(server.ProxyJump, ",") {
+		hop := Target{Name: jump}
+		jump = strings.TrimPrefix(strings.TrimSpace(jump), "ssh://")
+		if at := strings.LastIndex(jump, "@"); at >= 0 {
+			hop.Username = jump[:at]
+			jump = jump[at+1:]
+		}
+		if colon := strings.LastIndex(jump, ":"); colon >= 0 && !strings.HasSuffix(jump, "]") {
+			port, err := strconv.Atoi(jump[colon+1:])
+			if err != nil {
+				return nil, errors.New("Invalid ProxyJump port in " + server.ProxyJump)
+			}
+			hop.Port = port
+			jump = jump[:colon]
+		}
+		hop.SSHConfigHost = strings.Trim(jump, "[]")
+		if hop.SSHConfigHost == "" {
+			return nil, errors.New("Invalid ProxyJump " + server.ProxyJump)
+		}
+
+		resolved, err := hop.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		// Only one level of ProxyJump is followed, the chain is explicit
+		resolved.ProxyJump = ""
+		if resolved.Auth.Password == "" && resolved.Auth.PrivateKey == "" {
+			resolved.Auth = server.Auth
+		}
+		hops = append(hops, resolved)
+	}
+	return hops, nil
+}
+
+// Parse every existing ssh configuration file
+func loadSSHConfigs() ([]*ssh_config.Config, error) {
+	var configs []*ssh_config.Config
+	for _, path := range sshConfigFiles {
+		path = expandHome(path)
+		content, err := readSSHConfig(path, strings.HasPrefix(filepath.Clean(path), "/etc/ssh"), 0)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Unable to open ssh configuration %s: %v", path, err)
+		}
+		config, err := ssh_config.DecodeBytes([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse ssh configuration %s: %v", path, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// Nested Include followed at most, as ssh(1)
+const maxIncludeDepth = 16
+
+// Read an ssh configuration file for ssh_config, which fails on any Match
+// directive: Match blocks are left out, their conditions are not evaluated,
+// and Include directives are replaced by the files they include so that those
+// are read the same way. Relative includes are looked up in ~/.ssh, or in
+// /etc/ssh for the system configuration.
+func readSSHConfig(path string, system bool, depth int) (string, error) {
+	if depth > maxIncludeDepth {
+		return "", errors.New("Too many nested Include in " + path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var kept []string
+	// Host line of the block being read, which still applies after an
+	// included file
+	block := "Host *"
+	matching := false
+	for _, line := range strings.Split(string(content), "\n") {
+		keyword, arguments := sshConfigLine(line)
+		switch keyword {
+		case "host":
+			block = line
+			matching = false
+		case "match":
+			matching = true
+		}
+		if matching {
+			continue
+		}
+		if keyword != "include" {
+			kept = append(kept, line)
+			continue
+		}
+		for _, pattern := range arguments {
+			pattern = expandHome(pattern)
+			if !filepath.IsAbs(pattern) && system {
+				pattern = filepath.Join("/etc/ssh", pattern)
+			} else if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, match := range matches {
+				included, err := readSSHConfig(match, system, depth + 1)
+				if err != nil {
+					return "", err
+				}
+				kept = append(kept, included, block)
+			}
+		}
+	}
+	return strings.Join(kept, "\n"), nil
+}
+
+// Lowercase keyword and arguments of a line of ssh configuration, the keyword
+// is empty for blank lines and comments
+func sshConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	return strings.ToLower(line[:end]), strings.Fields(strings.TrimLeft(line[end:], " \t="))
+}
+
+// Expand the tokens allowed by ssh_config(5) in IdentityFile
+func expandSSHPath(path string, server Target) string {
+	path = expandHome(path)
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%d", expandHome("~"),
+		"%h", server.Hostname,
+		"%n", server.SSHConfigHost,
+		"%p", strconv.Itoa(server.Port),
+		"%r", server.Username,
+	)
+	return replacer.Replace(path)
+}
+
+// Replace a leading ~ by the home directory of the user running the watchdog
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
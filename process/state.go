@@ -0,0 +1,105 @@
+package process
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// What is persisted of a StartedProcess to re-adopt it after a restart of the
+// watchdog. Targets are only referenced by name to keep credentials out of the
+// state file.
+type savedProcess struct {
+	ID string         `json:"id"`
+	Name string       `json:"name"`
+	Target string     `json:"target"`
+	Pid int           `json:"pid"`
+	StartTime uint64  `json:"start_time"`
+	Started time.Time `json:"started"`
+	Cmdline string    `json:"cmdline"`
+	Exe string        `json:"exe"`
+	Executable string `json:"executable"`
+	Logs Logs         `json:"logs"`
+	RunAs string      `json:"run_as"`
+	Sudo bool         `json:"sudo"`
+}
+
+// SaveState write the instance registry to path. Streamed processes are left
+// out as they die with the SSH session of the watchdog.
+func SaveState(path string, processes []StartedProcess) error {
+	saved := []savedProcess{}
+	for _, process := range processes {
+		if process.Logs.Mode == StreamLogs || process.StartTime == 0 {
+			continue
+		}
+		saved = append(saved, savedProcess{
+			ID: process.ID,
+			Name: process.Name,
+			Target: process.Server.Name,
+			Pid: process.Pid,
+			StartTime: process.StartTime,
+			Started: process.Started,
+			Cmdline: process.Cmdline,
+			Exe: process.Exe,
+			Executable: process.Executable,
+			Logs: process.Logs,
+			RunAs: process.RunAs,
+			Sudo: process.Sudo,
+		})
+	}
+	content, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated state
+	temporary, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	temporary.Close()
+	return os.Rename(temporary.Name(), path)
+}
+
+// LoadState read the instance registry saved at path, the Server of each
+// process only holds the name of its target. A missing file is an empty
+// registry. Instances of a previous run are considered READY.
+func LoadState(path string) ([]StartedProcess, error) {
+	var processes []StartedProcess
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return processes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved []savedProcess
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range saved {
+		processes = append(processes, StartedProcess{
+			ID: entry.ID,
+			Executable: entry.Executable,
+			Server: Target{Name: entry.Target},
+			Pid: entry.Pid,
+			Logs: entry.Logs,
+			Name: entry.Name,
+			RunAs: entry.RunAs,
+			Sudo: entry.Sudo,
+			StartTime: entry.StartTime,
+			Cmdline: entry.Cmdline,
+			Exe: entry.Exe,
+			Started: entry.Started,
+			state: newInstanceState(nil),
+		})
+	}
+	return processes, nil
+}
@@ -0,0 +1,154 @@
+package process
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExitStatus define how a process ended
+type ExitStatus struct {
+	// Exit code of the process, -1 when it was terminated by a signal
+	Code int         `json:"code"`
+	// Name of the terminating signal (SIGTERM, SIGKILL...) if any
+	Signal string    `json:"signal,omitempty"`
+	Time time.Time   `json:"time"`
+}
+
+// Completion of a process the watchdog is attached to, shared by every copy of
+// its StartedProcess
+type attachedExit struct {
+	done chan struct{}
+	status *ExitStatus
+}
+
+// Status return how the process ended, or nil while it is still running.
+// Detached remote processes are asked for the status file written by their
+// wrapper.
+func (process StartedProcess) Status() (*ExitStatus, error) {
+	status, err := process.status()
+	if status != nil && process.state != nil {
+		process.state.lock.Lock()
+		process.state.exitStatus = status
+		process.state.lock.Unlock()
+	}
+	return status, err
+}
+
+// LastExit return how the instance ended when it is already known, without
+// asking the target
+func (process StartedProcess) LastExit() *ExitStatus {
+	if process.exit != nil {
+		select {
+		case <-process.exit.done:
+			return process.exit.status
+		default:
+			return nil
+		}
+	}
+	if process.state == nil {
+		return nil
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	return process.state.exitStatus
+}
+
+// Up report whether the instance is running. An instance the watchdog is not
+// attached to is known to have ended from its status or its usage samples.
+func (process StartedProcess) Up() bool {
+	if process.LastExit() != nil {
+		return false
+	}
+	if process.state == nil {
+		return true
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	return !process.state.gone
+}
+
+// Read how the process ended
+func (process StartedProcess) status() (*ExitStatus, error) {
+	if process.exit != nil {
+		select {
+		case <-process.exit.done:
+			return process.exit.status, nil
+		default:
+			return nil, nil
+		}
+	}
+	if process.Server.Name == "local" {
+		// An adopted local process is not a child, how it ended is unknown
+		same, err := process.IsSameProcess()
+		if err != nil || same {
+			return nil, err
+		}
+		return &ExitStatus{Code: -1, Time: time.Now()}, nil
+	}
+
+	// Polled every few seconds for each instance, on a connection they share
+	command := "cat " + statusFile(process.Logs, strconv.Itoa(process.Pid)) + " 2> /dev/null || true"
+	output, err := runPoll(process.Server, command)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(output)
+}
+
+// Path of the file in which the remote wrapper record the exit status of pid
+func statusFile(logs Logs, pid string) string {
+	return logs.Stdout + "." + pid + ".status"
+}
+
+// Parse the "code time [signal]" line written by the remote wrapper, an empty
+// content means the process is still running
+func parseStatus(content string) (*ExitStatus, error) {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return nil, nil
+	} else if len(fields) < 2 {
+		return nil, errors.New("Malformed exit status " + content)
+	}
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, errors.New("Malformed exit status " + content)
+	}
+	end, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Malformed exit status " + content)
+	}
+
+	status := &ExitStatus{Code: code, Time: time.Unix(end, 0)}
+	if len(fields) > 2 {
+		status.Code = -1
+		status.Signal = fields[2]
+		if !strings.HasPrefix(status.Signal, "SIG") {
+			status.Signal = "SIG" + status.Signal
+		}
+	}
+	return status, nil
+}
+
+// Convert the state of a local process which ended into an ExitStatus
+func exitStatusOf(state *os.ProcessState) *ExitStatus {
+	status := &ExitStatus{Code: -1, Time: time.Now()}
+	if state == nil {
+		return status
+	}
+	waitStatus, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return status
+	}
+	if waitStatus.Signaled() {
+		status.Signal = unix.SignalName(waitStatus.Signal())
+	} else {
+		status.Code = waitStatus.ExitStatus()
+	}
+	return status
+}
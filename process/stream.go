@@ -0,0 +1,154 @@
+package process
+
+import (
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Logs.Mode piping the output of remote processes to the watchdog host
+const StreamLogs = "stream"
+
+// Run a Process on a remote server attached to a persistent SSH session, its
+// output is written to the same local loggers RunProcess use and its exit
+// status is the one of the session. No PTY is requested so that stdout and
+// stderr stay apart, losing the session therefore does not end the process:
+// it is sent SIGTERM over a new connection instead, if the target can be
+// reached again within streamLossTimeout.
+func (runtime Process) runStreamedProcess(server Target) (*StartedProcess, error) {
+	var waiting sync.WaitGroup
+	session, err := createSSHSession(server)
+	if err != nil {
+		return nil, errors.New("Failed to obtain an SSH session")
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, errors.New("Impossible to pipe stdout")
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		session.Close()
+		return nil, errors.New("Impossible to pipe stderr")
+	}
+
+	command := wrapPrivilege(createStreamCommand(runtime.Executable, runtime.Arguments),
+		runtime.RunAs, runtime.Sudo)
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, errors.New("Command : " + command + " : failed")
+	}
+
+	// The first line is the PID, the process output follows
+	reader := bufio.NewReader(stdout)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		session.Close()
+		return nil, errors.New("Unexpected output")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		session.Close()
+		return nil, errors.New("Unexpected output")
+	}
+
+	stdoutLog, stderrLog, err := runtime.Logs.open()
+	if err != nil {
+		session.Close()
+		return nil, errors.New("Failed to create the loggers")
+	}
+
+	state := newInstanceState(runtime.Readiness)
+	state.capturing = true
+	state.prepareCapture(runtime)
+	waiting.Add(1)
+	go func() {
+		defer waiting.Done()
+		logLines(reader, stdoutLog, state.capture("stdout"))
+	}()
+
+	waiting.Add(1)
+	go func() {
+		defer waiting.Done()
+		logLines(stderr, stderrLog, state.capture("stderr"))
+	}()
+
+	exit := &attachedExit{done: make(chan struct{})}
+	started := &StartedProcess{
+		Executable: runtime.Executable,
+		Server: server,
+		Pid: pid,
+		Logs: runtime.Logs,
+		Name: runtime.Name,
+		RunAs: runtime.RunAs,
+		Sudo: runtime.Sudo,
+		Started: time.Now(),
+		exit: exit,
+		state: state,
+	}
+	started.identify()
+	go func() {
+		err := session.Wait()
+		if _, exited := err.(*ssh.ExitError); err != nil && !exited {
+			// The connection was lost, the process would keep running unwatched
+			terminateLost(*started)
+		}
+		waiting.Wait()
+		session.Close()
+		stdoutLog.close()
+		stderrLog.close()
+		exit.status = sessionExitStatus(err)
+		close(exit.done)
+	}()
+	started.trackReadiness(runtime.Readiness)
+	return started, nil
+}
+
+// Time given to reach the target again to terminate a process whose session
+// was lost, and between the attempts
+var streamLossTimeout = time.Minute
+var streamLossRetry = 5 * time.Second
+
+// Send SIGTERM to a streamed process whose session was lost, until it is
+// delivered, the process is gone or streamLossTimeout
+func terminateLost(process StartedProcess) {
+	deadline := time.Now().Add(streamLossTimeout)
+	for {
+		err := process.Signal(syscall.SIGTERM)
+		if err == nil || err == ErrPIDReused || time.Now().Add(streamLossRetry).After(deadline) {
+			return
+		}
+		time.Sleep(streamLossRetry)
+	}
+}
+
+// Create the command printing its PID before replacing itself by the process
+func createStreamCommand(executable string, arguments []string) string {
+	return "echo $$; exec " + executable + " " + strings.Join(arguments, " ")
+}
+
+// Convert the result of an SSH session into an ExitStatus
+func sessionExitStatus(err error) *ExitStatus {
+	status := &ExitStatus{Time: time.Now()}
+	if err == nil {
+		return status
+	}
+	exitError, ok := err.(*ssh.ExitError)
+	if !ok {
+		// The connection was lost, how the process ended is unknown
+		status.Code = -1
+		return status
+	}
+	status.Code = exitError.ExitStatus()
+	if exitError.Signal() != "" {
+		status.Code = -1
+		status.Signal = "SIG" + exitError.Signal()
+	}
+	return status
+}
@@ -0,0 +1,246 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage is a sample of the resources used by an instance
+type Usage struct {
+	Time time.Time     `json:"time"`
+	// Percent of one CPU used since the previous sample
+	CPU float64        `json:"cpu"`
+	// Resident memory in bytes
+	RSS uint64         `json:"rss"`
+	// Open file descriptors, 0 when they can not be listed
+	FDs int            `json:"fds"`
+	Threads int        `json:"threads"`
+	// Bytes read from and written to storage since the process started, 0
+	// when /proc/<pid>/io can not be read
+	ReadBytes uint64   `json:"read_bytes"`
+	WriteBytes uint64  `json:"write_bytes"`
+
+	// CPU time of the process in clock ticks and uptime of its host in
+	// seconds, the CPU percent is computed from two samples
+	ticks uint64
+	uptime float64
+}
+
+// Samples kept per instance
+const usageHistory = 60
+
+// Clock ticks per second of /proc/<pid>/stat (USER_HZ)
+const clockTicks = 100
+
+// Usage return the last sample of the resources used by the instance, nil
+// if it was never sampled
+func (process StartedProcess) Usage() *Usage {
+	history := process.UsageHistory()
+	if len(history) == 0 {
+		return nil
+	}
+	return &history[len(history) - 1]
+}
+
+// UsageHistory return the last samples of the instance, oldest first
+func (process StartedProcess) UsageHistory() []Usage {
+	if process.state == nil {
+		return nil
+	}
+	process.state.lock.Lock()
+	defer process.state.lock.Unlock()
+	return append([]Usage(nil), process.state.usage...)
+}
+
+// SampleUsage read the resources used by every running instance and add them
+// to its history. Instances on a remote target are read with a single SSH
+// command per target.
+func SampleUsage(processes []StartedProcess) error {
+	var failures []string
+	groups := make(map[string][]StartedProcess)
+	for _, process := range processes {
+		if process.state == nil || process.unwatched() {
+			continue
+		}
+		if process.Server.Name == "local" {
+			usage, err := readLocalUsage(process)
+			if err == nil {
+				process.state.record(usage)
+			} else if err == errNoProcess || err == ErrPIDReused {
+				process.state.vanish()
+			} else {
+				failures = append(failures, process.ID + ": " + err.Error())
+			}
+			continue
+		}
+		// Instances of a target running as different users are read with
+		// their own privileges
+		key := process.Server.Name + "\x00" + process.RunAs + "\x00" + strconv.FormatBool(process.Sudo)
+		groups[key] = append(groups[key], process)
+	}
+
+	for _, group := range groups {
+		if err := sampleRemoteUsage(group); err != nil {
+			failures = append(failures, group[0].Server.Name + ": " + err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Unable to sample usage of " + strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// Read the usage of a local process from /proc
+func readLocalUsage(process StartedProcess) (Usage, error) {
+	directory := "/proc/" + strconv.Itoa(process.Pid)
+	stat, err := ioutil.ReadFile(directory + "/stat")
+	if err != nil {
+		return Usage{}, errNoProcess
+	}
+	uptime, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return Usage{}, err
+	}
+	status, _ := ioutil.ReadFile(directory + "/status")
+	io, _ := ioutil.ReadFile(directory + "/io")
+	fds := 0
+	if directory, err := os.Open(directory + "/fd"); err == nil {
+		names, _ := directory.Readdirnames(-1)
+		directory.Close()
+		fds = len(names)
+	}
+
+	block := string(stat) + string(status) + "\nfds " + strconv.Itoa(fds) + "\n" + string(io)
+	return parseUsage(process, string(uptime), block)
+}
+
+// Read the usage of processes running on the same target with the same
+// privileges in one command
+func sampleRemoteUsage(processes []StartedProcess) error {
+	var pids []string
+	byPid := make(map[string]StartedProcess)
+	for _, process := range processes {
+		pid := strconv.Itoa(process.Pid)
+		pids = append(pids, pid)
+		byPid[pid] = process
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	output, _, err := runRemote(ctx, processes[0], usageCommand(pids))
+	if err != nil {
+		return err
+	}
+
+	// The uptime of the target comes first, then a block per process alive
+	blocks := strings.Split(output, "\n== ")
+	for _, block := range blocks[1:] {
+		lines := strings.SplitN(block, "\n", 2)
+		pid := strings.TrimSpace(lines[0])
+		process, ok := byPid[pid]
+		if !ok || len(lines) < 2 {
+			continue
+		}
+		usage, err := parseUsage(process, blocks[0], lines[1])
+		if err != nil {
+			continue
+		}
+		process.state.record(usage)
+		delete(byPid, pid)
+	}
+	// The processes left are no longer running
+	for _, process := range byPid {
+		process.state.vanish()
+	}
+	return nil
+}
+
+// Create the command printing the uptime of the target then, for each PID
+// still running, its stat, status, open file descriptors and io
+func usageCommand(pids []string) string {
+	return "cat /proc/uptime; for pid in " + strings.Join(pids, " ") + "; do " +
+		"if [ -r /proc/$pid/stat ]; then echo \"== $pid\"; cat /proc/$pid/stat /proc/$pid/status; " +
+		"echo \"fds $(ls /proc/$pid/fd | wc -l)\"; cat /proc/$pid/io; fi; done 2> /dev/null"
+}
+
+// Parse the uptime of the host and a block made of the stat of the process
+// followed by "key: value" lines from its status, fds count and io
+func parseUsage(process StartedProcess, uptime string, block string) (Usage, error) {
+	fields := strings.Fields(uptime)
+	if len(fields) == 0 {
+		return Usage{}, errors.New("Malformed uptime " + uptime)
+	}
+	usage := Usage{Time: time.Now()}
+	var err error
+	if usage.uptime, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return Usage{}, errors.New("Malformed uptime " + uptime)
+	}
+
+	lines := strings.SplitN(block, "\n", 2)
+	stat := lines[0]
+	current, err := parseIdentity(stat, "", "")
+	if err != nil {
+		return Usage{}, err
+	}
+	if process.StartTime != 0 && current.startTime != process.StartTime {
+		return Usage{}, ErrPIDReused
+	}
+	// utime, stime and num_threads are the 14th, 15th and 20th fields
+	fields = strings.Fields(stat[strings.LastIndex(stat, ")") + 1:])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	usage.ticks = utime + stime
+	usage.Threads, _ = strconv.Atoi(fields[17])
+
+	if len(lines) < 2 {
+		return usage, nil
+	}
+	for _, line := range strings.Split(lines[1], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.TrimSuffix(fields[0], ":") {
+		case "VmRSS":
+			kilobytes, _ := strconv.ParseUint(fields[1], 10, 64)
+			usage.RSS = kilobytes * 1024
+		case "fds":
+			usage.FDs, _ = strconv.Atoi(fields[1])
+		case "read_bytes":
+			usage.ReadBytes, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "write_bytes":
+			usage.WriteBytes, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return usage, nil
+}
+
+// Mark the process as no longer running
+func (state *instanceState) vanish() {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.gone = true
+}
+
+// Add a sample to the history of the instance, computing the CPU used since
+// the previous one
+func (state *instanceState) record(usage Usage) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if len(state.usage) > 0 {
+		previous := state.usage[len(state.usage) - 1]
+		elapsed := usage.uptime - previous.uptime
+		if elapsed > 0 && usage.ticks >= previous.ticks {
+			usage.CPU = float64(usage.ticks - previous.ticks) / clockTicks / elapsed * 100
+		}
+	}
+	state.usage = append(state.usage, usage)
+	if len(state.usage) > usageHistory {
+		state.usage = state.usage[len(state.usage) - usageHistory:]
+	}
+}
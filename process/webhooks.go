@@ -0,0 +1,198 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Webhook POST the notifications to a URL, by default as JSON
+type Webhook struct {
+	URL string                  `json:"url"`
+	// Headers of the requests, such as Authorization. Content-Type is
+	// application/json by default.
+	Headers map[string]string   `json:"headers"`
+	// text/template of the body executed on the Notification, its json
+	// function encode a value. The Notification as JSON by default.
+	Template string              `json:"template"`
+	// Retries of a failed request (3 by default, none when negative) and the
+	// delay before the first one (1s by default), doubled at each retry and
+	// spread by a random jitter of half of it
+	Retries int                  `json:"retries"`
+	RetryDelay Duration          `json:"retry_delay"`
+	// Time given to each request, 10s by default
+	Timeout Duration             `json:"timeout"`
+	NotifyFilter
+}
+
+// Retries of the webhooks by default
+const defaultWebhookRetries = 3
+
+// Validate return an error if the webhook can not be called
+func (webhook Webhook) Validate() error {
+	parsed, err := url.Parse(webhook.URL)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("Webhook require an http or https URL")
+	}
+	if webhook.RetryDelay < 0 || webhook.Timeout < 0 {
+		return errors.New("Webhook durations can not be negative")
+	}
+	if _, err := webhookTemplate(webhook.Template); err != nil {
+		return err
+	}
+	return webhook.NotifyFilter.Validate()
+}
+
+// Parse the template of a webhook, nil for the default body
+func webhookTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("webhook").Funcs(notifyFuncs).Parse(text)
+}
+
+// Open webhook with its queue
+type webhookNotifier struct {
+	Webhook
+	*notifierQueue
+	template *template.Template
+	client *http.Client
+}
+
+// Check the configuration of a webhook and create its queue
+func openWebhook(webhook Webhook, logger *zap.Logger) (*webhookNotifier, error) {
+	if err := webhook.Validate(); err != nil {
+		return nil, err
+	}
+	if webhook.Retries == 0 {
+		webhook.Retries = defaultWebhookRetries
+	}
+	parsed, _ := webhookTemplate(webhook.Template)
+	return &webhookNotifier{
+		Webhook: webhook,
+		notifierQueue: newNotifierQueue(webhook.NotifyFilter, logger),
+		template: parsed,
+		client: &http.Client{Timeout: webhook.Timeout.or(10 * time.Second)},
+	}, nil
+}
+
+// Send the notifications queued until the webhook is closed
+func (webhook *webhookNotifier) run() {
+	defer close(webhook.stopped)
+	for {
+		select {
+		case notification := <-webhook.notifications:
+			webhook.send(notification)
+		case <-webhook.closing:
+			for {
+				select {
+				case notification := <-webhook.notifications:
+					webhook.send(notification)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Error of a request answered with a status other than 2xx
+type webhookStatusError struct {
+	code int
+}
+
+func (err webhookStatusError) Error() string {
+	return "Webhook answered " + strconv.Itoa(err.code)
+}
+
+// Whether the request may succeed when sent again
+func (err webhookStatusError) temporary() bool {
+	return err.code >= 500 || err.code == http.StatusTooManyRequests ||
+		err.code == http.StatusRequestTimeout
+}
+
+// Post a notification, log it when it could not be delivered
+func (webhook *webhookNotifier) send(notification Notification) {
+	if err := webhook.post(notification); err != nil {
+		webhook.logger.Error("Unable to send the notification to a webhook",
+			zap.String("host", webhook.host()), zap.String("kind", notification.Kind),
+			zap.String("instance", notification.Instance), zap.String("target", notification.Target),
+			zap.Error(err))
+	}
+}
+
+// Host of the URL of the webhook, its path and query may hold a secret
+func (webhook *webhookNotifier) host() string {
+	parsed, _ := url.Parse(webhook.URL)
+	return parsed.Host
+}
+
+// Send a notification, retrying on network errors and temporary statuses
+func (webhook *webhookNotifier) post(notification Notification) error {
+	body, err := webhook.body(notification)
+	if err != nil {
+		return err
+	}
+	delay := webhook.RetryDelay.or(time.Second)
+	for attempt := 0; ; attempt++ {
+		err = webhook.request(body)
+		status, answered := err.(webhookStatusError)
+		if err == nil || attempt >= webhook.Retries || (answered && !status.temporary()) {
+			return err
+		}
+		// Notifiers failing together do not retry all at once
+		time.Sleep(delay / 2 + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
+
+// Body of the request of a notification
+func (webhook *webhookNotifier) body(notification Notification) ([]byte, error) {
+	if webhook.template == nil {
+		return json.Marshal(notification)
+	}
+	var body bytes.Buffer
+	if err := webhook.template.Execute(&body, notification); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// POST a body to the URL of the webhook
+func (webhook *webhookNotifier) request(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "watchdog")
+	for name, value := range webhook.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := webhook.client.Do(request)
+	if urlError, ok := err.(*url.Error); ok {
+		// Its message holds the URL, which may hold a secret
+		return urlError.Err
+	} else if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return webhookStatusError{response.StatusCode}
+	}
+	return nil
+}
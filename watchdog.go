@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"os"
 	"sync"
 	"time"
@@ -12,19 +14,51 @@ import (
 	"syscall"
 	"watchdog/process"
 	"os/signal"
+	"os/exec"
 )
 
 var logger *zap.Logger
 var configuration Config
 var targetMap map[string]process.Target
 var loadedProcess map[string]process.Process
-var launchedProcess map[int]process.StartedProcess
+// Configured processes sorted so each one comes after its dependencies
+var startOrder []process.Process
+// Started instances by ID, guarded by launchedLock
+var launchedProcess map[string]process.StartedProcess
+var launchedLock sync.Mutex
+// IDs of the instances being restarted or killed on purpose, guarded by
+// launchedLock
+var stopping = make(map[string]bool)
+// Watchers registered by watch, set again on restarted instances
+var watchers []watcher
+
+// Callbacks registered on every instance of a process
+type watcher struct {
+	processName string
+	frequency int
+	onTick func(process.StartedProcess) (string, error)
+	onCrash func(*process.StartedProcess) error
+}
 
 type Process process.Process
 // Structure obtained via jsonutil
 type Config struct {
 	Processes []process.Process `json:"processes"`
 	Targets   []process.Target  `json:"target"`
+	// Where the instance registry is persisted to re-adopt instances
+	StateFile string            `json:"state_file"`
+	// Listen address of the status API, disabled when empty
+	Control string              `json:"control"`
+	// Time between two samples of the resources used by the instances (10s)
+	UsageInterval process.Duration `json:"usage_interval"`
+	// Log servers receiving the output of processes, and those receiving the
+	// watchdog log
+	Sinks []process.Sink        `json:"sinks"`
+	LogSinks []string           `json:"log_sinks"`
+	// Bundles collected when an instance crash, disabled when absent
+	CrashReports *process.CrashReports `json:"crash_reports"`
+	// Webhooks and emails receiving the events of the instances
+	Notifiers process.Notifiers `json:"notifiers"`
 }
 
 // Initialize the global logger
@@ -35,13 +69,37 @@ func initializeLogger() {
 
 // Load the configuration file and initialize top level variables
 func initializeConfig() {
-	launchedProcess = make(map[int]process.StartedProcess)
+	launchedProcess = make(map[string]process.StartedProcess)
 	configfile, err := ioutil.ReadFile("config.json")
 	if err != nil {
 		logger.Fatal("Unable to open configuration file")
 		os.Exit(255)
 	}
 	json.Unmarshal(configfile, &configuration)
+	if configuration.StateFile == "" {
+		configuration.StateFile = "watchdog.state.json"
+	}
+
+	if configuration.CrashReports != nil {
+		if err := configuration.CrashReports.Validate(); err != nil {
+			logger.Fatal("Invalid crash reports", zap.Error(err))
+		}
+	}
+	if err := process.OpenSinks(configuration.Sinks); err != nil {
+		logger.Fatal("Invalid sinks", zap.Error(err))
+	}
+	if err := process.OpenNotifiers(configuration.Notifiers, logger); err != nil {
+		logger.Fatal("Invalid notifiers", zap.Error(err))
+	}
+	if len(configuration.LogSinks) > 0 {
+		core, err := process.SinkCore(configuration.LogSinks, zap.InfoLevel)
+		if err != nil {
+			logger.Fatal("Invalid log sinks", zap.Error(err))
+		}
+		logger = logger.WithOptions(zap.WrapCore(func(file zapcore.Core) zapcore.Core {
+			return zapcore.NewTee(file, core)
+		}))
+	}
 
 	// Convert my JSON array into a map to avoid multiple array walkthrough
 	targetMap = make(map[string]process.Target)
@@ -52,54 +110,73 @@ func initializeConfig() {
 	loadedProcess = make(map[string]process.Process)
 	for _, process := range configuration.Processes {
 		loadedProcess[process.Name] = process
+		if err := process.Validate(); err != nil {
+			logger.Fatal("Invalid configuration for " + process.Name, zap.Error(err))
+		}
+	}
+	for _, processus := range configuration.Processes {
+		for _, sink := range processus.Logs.Sinks {
+			if !process.SinkExists(sink) {
+				logger.Fatal("Unknown sink " + sink + " for " + processus.Name)
+			}
+		}
+	}
+	startOrder, err = process.StartOrder(configuration.Processes)
+	if err != nil {
+		logger.Fatal("Invalid process dependencies", zap.Error(err))
 	}
 }
 
 func main() {
 	var waiting sync.WaitGroup
 
+	if len(os.Args) > 1 && os.Args[1] == "logs" {
+		os.Exit(logsCommand(os.Args[2:]))
+	}
+
 	initializeLogger()
 	initializeConfig()
+	startControl()
+	saved := loadState()
 
-	// Launch every Command loaded from the config file in a separate goroutine.
-	for _, processus := range configuration.Processes {
-		for i := 0; i < processus.Number; i++ {
-			waiting.Add(1)
-			// This goroutine takes this as a parameter due to the stack
-			// architecture to prevent stack overwriting of this
-			// variable
-			go func(processus process.Process){
-				defer waiting.Done()
-				if processus.Target == "local" {
-					started, err := process.RunProcess(
-						processus.Executable,
-						processus.Logs.Stdout,
-						processus.Logs.Stderr,
-						processus.Name,
-						processus.Arguments...
-					)
-					if err != nil {
-						logger.Fatal("Unable to create local process")
-						killAll()
-						os.Exit(1)
-					}
-					logger.Info("Local process started")
-					launchedProcess[started.Pid] = started
-				} else {
-					started, err := processus.RunRemoteProcess(targetMap[processus.Target])
-					if err != nil {
-						logger.Fatal("Unable to create remote process")
-						killAll()
-						os.Exit(1)
-					}
-					logger.Info("Remote process started")
-					launchedProcess[started.Pid] = *started
+	// Launch every Command loaded from the config file in a separate goroutine
+	// once its dependencies meet their condition, unless its instance
+	// survived the previous run of the watchdog.
+	started := make(map[string]chan struct{})
+	for _, processus := range startOrder {
+		started[processus.Name] = make(chan struct{})
+	}
+	for _, processus := range startOrder {
+		waiting.Add(1)
+		// This goroutine takes this as a parameter due to the stack
+		// architecture to prevent stack overwriting of this
+		// variable
+		go func(processus process.Process){
+			defer waiting.Done()
+			for dependency, condition := range processus.DependsOn {
+				<-started[dependency]
+				if condition != process.DependencyReady {
+					continue
 				}
-			}(processus)
-		}
+				if err := waitInstancesReady(dependency); err != nil {
+					logger.Error("Dependency " + dependency + " of " + processus.Name + " not ready",
+						zap.Error(err))
+					abort(process.StartedProcess{Name: processus.Name,
+						Server: process.Target{Name: processus.Target}},
+						"Dependency " + dependency + " not ready: " + err.Error())
+				}
+			}
+			launchInstances(processus, saved)
+			close(started[processus.Name])
+		}(processus)
 	}
 
 	waiting.Wait()
+	saveState()
+	waitReady()
+	setupChecks()
+	setupUsage()
+	watchTargets()
 	setupWatcher()
 
 	// Setup a trap on CTRL + C and on CTRL + D which call killAll()
@@ -109,6 +186,8 @@ func main() {
 	go func() {
 		<-sigs
 		killAll()
+		process.CloseNotifiers(5 * time.Second)
+		process.CloseSinks(5 * time.Second)
 		os.Exit(1)
 	}()
 	waiting.Add(1)
@@ -119,6 +198,21 @@ func main() {
 func watch(processName string, frequency int, onTick func(process.StartedProcess) (string, error),
 	onCrash func(*process.StartedProcess) error) {
 
+	// Time the callbacks for the metrics
+	timedTick := onTick
+	onTick = func(processus process.StartedProcess) (string, error) {
+		defer timeCallback(processName, "tick", time.Now())
+		return timedTick(processus)
+	}
+	timedCrash := onCrash
+	onCrash = func(processus *process.StartedProcess) error {
+		defer timeCallback(processName, "crash", time.Now())
+		return timedCrash(processus)
+	}
+
+	launchedLock.Lock()
+	defer launchedLock.Unlock()
+	watchers = append(watchers, watcher{processName, frequency, onTick, onCrash})
 	for _, processus := range launchedProcess {
 		if processName == processus.Name {
 			logger.Info("Add watcher on " + processName)
@@ -127,14 +221,364 @@ func watch(processName string, frequency int, onTick func(process.StartedProcess
 	}
 }
 
-// Kill every process started by the watchdog
+// Launch or adopt every instance of a process, exit if one fails to start
+func launchInstances(processus process.Process, saved map[string]process.StartedProcess) {
+	var waiting sync.WaitGroup
+	for i := 0; i < processus.Number; i++ {
+		id := instanceID(processus, i)
+		if previous, ok := saved[id]; ok && adopt(previous, processus) {
+			continue
+		}
+		waiting.Add(1)
+		go func(id string){
+			defer waiting.Done()
+			if err := launch(processus, id); err != nil {
+				logger.Error("Unable to create process " + id, zap.Error(err))
+				abort(process.StartedProcess{ID: id, Name: processus.Name,
+					Server: process.Target{Name: processus.Target}}, "Unable to start: " + err.Error())
+			}
+			launchedLock.Lock()
+			started := launchedProcess[id]
+			launchedLock.Unlock()
+			recordEvent(eventStarted, started, true, "Started pid " + strconv.Itoa(started.Pid))
+		}(id)
+	}
+	waiting.Wait()
+}
+
+// Record a fatal event on an instance, kill every instance and exit once the
+// notifiers sent it
+func abort(processus process.StartedProcess, message string) {
+	recordEvent(eventFatal, processus, true, message)
+	killAll()
+	process.CloseNotifiers(5 * time.Second)
+	process.CloseSinks(5 * time.Second)
+	os.Exit(1)
+}
+
+// Wait for every instance of a process to pass its readiness probes
+func waitInstancesReady(processName string) error {
+	for _, processus := range instancesOf(processName) {
+		if err := processus.WaitReady(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registered instances of a process
+func instancesOf(processName string) []process.StartedProcess {
+	launchedLock.Lock()
+	defer launchedLock.Unlock()
+	var instances []process.StartedProcess
+	for _, processus := range launchedProcess {
+		if processus.Name == processName {
+			instances = append(instances, processus)
+		}
+	}
+	return instances
+}
+
+// Wait for every instance to pass its readiness probes
+func waitReady() {
+	launchedLock.Lock()
+	var instances []process.StartedProcess
+	for _, processus := range launchedProcess {
+		instances = append(instances, processus)
+	}
+	launchedLock.Unlock()
+
+	for _, processus := range instances {
+		if err := processus.WaitReady(); err != nil {
+			logger.Warn("Instance not ready", zap.String("instance", processus.ID), zap.Error(err))
+		} else {
+			logger.Info("Instance " + processus.ID + " ready")
+		}
+	}
+}
+
+// Start the checks declared in the configuration on every instance
+func setupChecks() {
+	launchedLock.Lock()
+	defer launchedLock.Unlock()
+	for _, processus := range launchedProcess {
+		supervise(processus)
+	}
+}
+
+// Time between two checks of whether an instance ended, in milliseconds
+const exitCheckInterval = 5000
+
+// Start the health, hang and notify checks declared in the configuration on an
+// instance, the rotation of its remote logs and the report of its end
+func supervise(processus process.StartedProcess) {
+	configured := loadedProcess[processus.Name]
+	processus.Watch(exitCheckInterval, func(process.StartedProcess) (string, error) {
+		return "", nil
+	}, reportExit)
+	if configured.HealthCheck != nil {
+		logger.Info("Add health check on " + processus.ID)
+		if err := processus.WatchHealth(*configured.HealthCheck, reportCrash); err != nil {
+			logger.Error("Unable to watch the health of " + processus.ID, zap.Error(err))
+		}
+	}
+	if configured.Hang != nil {
+		logger.Info("Add hang check on " + processus.ID)
+		if err := processus.WatchHang(*configured.Hang, restartHung); err != nil {
+			logger.Error("Unable to watch " + processus.ID + " for hangs", zap.Error(err))
+		}
+	}
+	if processus.Logs.Rotation != nil && processus.Server.Name != "local" &&
+		processus.Logs.Mode != process.StreamLogs {
+		if err := processus.WatchRemoteLogs(); err != nil {
+			logger.Error("Unable to rotate the logs of " + processus.ID, zap.Error(err))
+		}
+	}
+	if len(configured.Alerts) > 0 {
+		logger.Info("Add alert rules on " + processus.ID)
+		if err := processus.WatchAlerts(handleAlert); err != nil {
+			logger.Error("Unable to watch the output of " + processus.ID, zap.Error(err))
+		}
+	}
+	if configured.NotifyWatchdog > 0 {
+		logger.Info("Add notify watchdog on " + processus.ID)
+		if err := processus.WatchNotify(configured.NotifyWatchdog, restartHung); err != nil {
+			logger.Warn("Unable to watch the pings of " + processus.ID, zap.Error(err))
+		}
+	}
+}
+
+// Sample the resources used by every instance at the usage interval
+func setupUsage() {
+	interval := time.Duration(configuration.UsageInterval)
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go func() {
+		for range time.Tick(interval) {
+			launchedLock.Lock()
+			var instances []process.StartedProcess
+			for id, processus := range launchedProcess {
+				if !stopping[id] {
+					instances = append(instances, processus)
+				}
+			}
+			launchedLock.Unlock()
+			if err := process.SampleUsage(instances); err != nil {
+				logger.Warn("Resource usage sampling failed", zap.Error(err))
+			}
+			for _, processus := range instances {
+				for _, rule := range processus.CheckResources(loadedProcess[processus.Name].Resources) {
+					go enforce(processus, rule)
+				}
+			}
+		}
+	}()
+}
+
+// Time between two checks of the SSH connections to the targets
+const targetCheckInterval = 10 * time.Second
+
+// Record a target-down event when connections to a target start failing
+func watchTargets() {
+	go func() {
+		previous := process.SSHDialErrors()
+		down := make(map[string]bool)
+		for range time.Tick(targetCheckInterval) {
+			counts := process.SSHDialErrors()
+			for target, count := range counts {
+				failed := count - previous[target]
+				if failed > 0 && !down[target] {
+					recordEvent(eventTargetDown, process.StartedProcess{Server: process.Target{Name: target}}, true,
+						strconv.FormatUint(failed, 10) + " failed SSH connections")
+				}
+				down[target] = failed > 0
+			}
+			previous = counts
+		}
+	}()
+}
+
+// Apply the action of a resource rule exceeded by an instance
+func enforce(processus process.StartedProcess, rule process.ResourceRule) {
+	action := rule.Action
+	if action == "" {
+		action = process.ActionLog
+	}
+	message := rule.String()
+	if usage := processus.Usage(); usage != nil {
+		message += fmt.Sprintf(" (rss %s, cpu %.1f%%)", process.ByteSize(usage.RSS), usage.CPU)
+	}
+	recordEvent(eventResourceExceeded, processus, action != process.ActionLog, message + ": " + action)
+
+	switch action {
+	case process.ActionRestart:
+		if err := restart(processus); err != nil {
+			logger.Error("Unable to restart " + processus.ID, zap.Error(err))
+		}
+	case process.ActionKill:
+		if !reserve(processus) {
+			return
+		}
+		defer release(processus.ID)
+		if err := terminate(processus); err != nil {
+			logger.Error("Unable to kill " + processus.ID, zap.Error(err))
+			return
+		}
+		waitEnded([]process.StartedProcess{processus}, stopTimeout)
+		if status, err := processus.Status(); err != nil || status == nil {
+			logger.Error("Instance " + processus.ID + " still running after SIGKILL", zap.Error(err))
+			return
+		}
+		unregister(processus)
+	}
+}
+
+// Time given to the hook of an alert rule
+const hookTimeout = 30 * time.Second
+
+// Record an alert triggered by the output of an instance and run its action
+func handleAlert(processus *process.StartedProcess, alert process.Alert) error {
+	action := alert.Rule.Action
+	if action == "" {
+		action = process.ActionNotify
+	}
+	message := alert.Rule.String() + ": " + alert.Line
+	storeEvent(eventAlert, *processus, action != process.ActionHook, message + ": " + action,
+		processus.Tail(eventOutputLines))
+
+	switch action {
+	case process.ActionRestart:
+		return restart(*processus)
+	case process.ActionHook:
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		hook := exec.CommandContext(ctx, "sh", "-c", alert.Rule.Hook)
+		hook.Env = append(os.Environ(),
+			"WATCHDOG_PROCESS=" + processus.Name,
+			"WATCHDOG_INSTANCE=" + processus.ID,
+			"WATCHDOG_TARGET=" + processus.Server.Name,
+			"WATCHDOG_PATTERN=" + alert.Rule.Pattern,
+			"WATCHDOG_LINE=" + alert.Line,
+		)
+		if output, err := hook.CombinedOutput(); err != nil {
+			logger.Error("Alert hook of " + processus.ID + " failed", zap.Error(err),
+				zap.String("output", string(output)))
+			return err
+		}
+	}
+	return nil
+}
+
+// Hang handler of the checks declared in the configuration
+func restartHung(processus *process.StartedProcess, reason error) error {
+	recordFailure(eventHung, *processus, reason.Error())
+	return restart(*processus)
+}
+
+// Replace an instance by a new one with the same ID and the same watchers
+func restart(previous process.StartedProcess) error {
+	if !reserve(previous) {
+		// Already replaced, stopped or being restarted
+		return nil
+	}
+	defer release(previous.ID)
+
+	if err := terminate(previous); err != nil {
+		return err
+	}
+	countRestart(previous)
+
+	if err := launch(loadedProcess[previous.Name], previous.ID); err != nil {
+		logger.Error("Unable to restart " + previous.ID, zap.Error(err))
+		launchedLock.Lock()
+		delete(launchedProcess, previous.ID)
+		launchedLock.Unlock()
+		saveState()
+		recordEvent(eventFatal, previous, true, "Unable to restart: " + err.Error())
+		return err
+	}
+	launchedLock.Lock()
+	started := launchedProcess[previous.ID]
+	for _, watcher := range watchers {
+		if watcher.processName == started.Name {
+			go started.Watch(watcher.frequency, watcher.onTick, watcher.onCrash)
+		}
+	}
+	launchedLock.Unlock()
+	supervise(started)
+	saveState()
+	recordEvent(eventRestarted, started, true, "Replaced pid " + strconv.Itoa(previous.Pid) +
+		" by " + strconv.Itoa(started.Pid))
+	return nil
+}
+
+// Crash handler of the checks declared in the configuration
+func reportCrash(processus *process.StartedProcess) error {
+	fields := []zap.Field{zap.String("instance", processus.ID), zap.Int("pid", processus.Pid),
+		zap.String("target", processus.Server.Name)}
+	if processus.ExitStatus != nil {
+		fields = append(fields, zap.Int("code", processus.ExitStatus.Code),
+			zap.String("signal", processus.ExitStatus.Signal))
+	}
+	logger.Error("Instance failed", fields...)
+	recordFailure(eventHealthFailed, *processus, "Health check failed")
+	return nil
+}
+
+// Record the end of an instance which was not stopped by the watchdog
+func reportExit(processus *process.StartedProcess) error {
+	launchedLock.Lock()
+	current, ok := launchedProcess[processus.ID]
+	launchedLock.Unlock()
+	if !ok || current.Pid != processus.Pid || !current.Started.Equal(processus.Started) {
+		return nil
+	}
+	message := "Instance ended"
+	if status := processus.ExitStatus; status != nil && status.Signal != "" {
+		message += " by signal " + status.Signal
+	} else if status != nil {
+		message += " with code " + strconv.Itoa(status.Code)
+	}
+	if configuration.CrashReports != nil {
+		if id, err := processus.CollectCrash(*configuration.CrashReports); err != nil {
+			logger.Error("Unable to collect the crash report of " + processus.ID, zap.Error(err))
+		} else {
+			message += ", crash report " + id
+		}
+	}
+	recordFailure(eventCrashed, *processus, message)
+	return nil
+}
+
+// Time given to the instances of a process to exit before its dependencies
+// are killed
+const stopTimeout = 10 * time.Second
+
+// Kill every process started by the watchdog, dependent processes first
 func killAll() error {
-	var err error
-	for index, process := range launchedProcess {
-		err = process.Kill()
-		if err != nil {
-			logger.Error("Failed to kill properly " + strconv.Itoa(process.Pid) + " on " +
-				process.Server.Name)
+	launchedLock.Lock()
+	defer saveState()
+	defer launchedLock.Unlock()
+	for i := len(startOrder) - 1; i >= 0; i-- {
+		var killed []process.StartedProcess
+		for index, processus := range launchedProcess {
+			if processus.Name != startOrder[i].Name {
+				continue
+			}
+			if err := killInstance(processus); err != nil {
+				return err
+			}
+			killed = append(killed, processus)
+			delete(launchedProcess, index)
+		}
+		if len(startOrder[i].DependsOn) > 0 {
+			waitEnded(killed, stopTimeout)
+		}
+	}
+	// Instances of processes no longer in the configuration
+	for index, processus := range launchedProcess {
+		if err := killInstance(processus); err != nil {
 			return err
 		}
 		delete(launchedProcess, index)
@@ -142,6 +586,175 @@ func killAll() error {
 	return nil
 }
 
+// Kill an instance, an instance already gone is not an error
+func killInstance(processus process.StartedProcess) error {
+	// Stopped on purpose, its end is not reported
+	processus.Retire()
+	err := processus.Kill()
+	if err == process.ErrProcessEnded {
+		// Nothing left to kill for this instance
+		return nil
+	} else if err == process.ErrPIDReused {
+		// The instance ended and another process got its PID, which is left
+		// alone
+		logger.Warn("PID " + strconv.Itoa(processus.Pid) + " of " + processus.ID +
+			" belongs to another process, not killed", zap.String("target", processus.Server.Name))
+		return nil
+	}
+	if err != nil {
+		logger.Error("Failed to kill properly " + strconv.Itoa(processus.Pid) + " on " +
+			processus.Server.Name)
+	}
+	return err
+}
+
+// Stop an instance on purpose with SIGTERM, then SIGKILL when it did not end
+// within the stop timeout
+func terminate(processus process.StartedProcess) error {
+	if err := killInstance(processus); err != nil {
+		return err
+	}
+	waitEnded([]process.StartedProcess{processus}, stopTimeout)
+	if status, err := processus.Status(); err == nil && status == nil {
+		processus.Signal(syscall.SIGKILL)
+	}
+	return nil
+}
+
+// Reserve an instance for a restart or a kill so that a single one proceeds,
+// false when it was already replaced, stopped or is being stopped
+func reserve(processus process.StartedProcess) bool {
+	launchedLock.Lock()
+	defer launchedLock.Unlock()
+	current, ok := launchedProcess[processus.ID]
+	if !ok || current.Pid != processus.Pid || !current.Started.Equal(processus.Started) ||
+		stopping[processus.ID] {
+		return false
+	}
+	stopping[processus.ID] = true
+	return true
+}
+
+// Release an instance reserved by reserve
+func release(id string) {
+	launchedLock.Lock()
+	delete(stopping, id)
+	launchedLock.Unlock()
+}
+
+// Remove an instance from the registry unless it was already replaced
+func unregister(processus process.StartedProcess) {
+	launchedLock.Lock()
+	current, ok := launchedProcess[processus.ID]
+	if ok && current.Pid == processus.Pid && current.Started.Equal(processus.Started) {
+		delete(launchedProcess, processus.ID)
+	}
+	launchedLock.Unlock()
+	saveState()
+}
+
+// Wait until every instance ended or the timeout expired
+func waitEnded(instances []process.StartedProcess, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, processus := range instances {
+		for time.Now().Before(deadline) {
+			status, err := processus.Status()
+			if err != nil || status != nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// Identifier of the index-th instance of a process
+func instanceID(processus process.Process, index int) string {
+	return fmt.Sprintf("%s-%d", processus.Name, index)
+}
+
+// Start an instance of the process and register it under id
+func launch(processus process.Process, id string) error {
+	var started process.StartedProcess
+	if processus.Target == "local" {
+		local, err := processus.RunLocalProcess()
+		if err != nil {
+			return err
+		}
+		logger.Info("Local process started")
+		started = *local
+	} else {
+		remote, err := processus.RunRemoteProcess(targetMap[processus.Target])
+		if err != nil {
+			return err
+		}
+		logger.Info("Remote process started")
+		started = *remote
+	}
+
+	started.SetID(id)
+	if configuration.CrashReports != nil {
+		if err := started.RecordEnvironment(); err != nil {
+			logger.Warn("Unable to read the environment of " + id, zap.Error(err))
+		}
+	}
+	launchedLock.Lock()
+	launchedProcess[id] = started
+	launchedLock.Unlock()
+	return nil
+}
+
+// Register again an instance of the previous run if it is still the same
+// process running the same configuration
+func adopt(previous process.StartedProcess, processus process.Process) bool {
+	if previous.Server.Name != processus.Target || previous.Executable != processus.Executable ||
+		previous.Logs.Stdout != processus.Logs.Stdout {
+		return false
+	}
+	if processus.Target != "local" {
+		previous.Server = targetMap[processus.Target]
+	}
+	same, err := previous.IsSameProcess()
+	if err != nil {
+		logger.Warn("Unable to verify instance " + previous.ID, zap.Error(err))
+		return false
+	} else if !same {
+		return false
+	}
+
+	logger.Info("Adopted instance " + previous.ID + " (" + strconv.Itoa(previous.Pid) + ")")
+	launchedLock.Lock()
+	launchedProcess[previous.ID] = previous
+	launchedLock.Unlock()
+	return true
+}
+
+// Load the instances registered by the previous run of the watchdog by ID
+func loadState() map[string]process.StartedProcess {
+	saved := make(map[string]process.StartedProcess)
+	processes, err := process.LoadState(configuration.StateFile)
+	if err != nil {
+		logger.Error("Unable to load the state file", zap.Error(err))
+		return saved
+	}
+	for _, processus := range processes {
+		saved[processus.ID] = processus
+	}
+	return saved
+}
+
+// Persist the registered instances
+func saveState() {
+	var processes []process.StartedProcess
+	launchedLock.Lock()
+	for _, processus := range launchedProcess {
+		processes = append(processes, processus)
+	}
+	launchedLock.Unlock()
+	if err := process.SaveState(configuration.StateFile, processes); err != nil {
+		logger.Error("Unable to save the state file", zap.Error(err))
+	}
+}
+
 // Create a Logger writing to the path specified in parameter
 func createLogger(filepath string) *zap.Logger {
 	cfg := zap.NewProductionConfig()